@@ -0,0 +1,70 @@
+package httperror
+
+import (
+	"net/http"
+	"strings"
+)
+
+// UnauthorizedBearer creates a 401 Unauthorized error with an RFC 6750 Bearer challenge,
+// e.g. UnauthorizedBearer("invalid_token", "The access token expired")
+func UnauthorizedBearer(errCode, description string) HTTPError {
+	params := []string{}
+	if errCode != "" {
+		params = append(params, `error="`+quoteEscape(errCode)+`"`)
+	}
+	if description != "" {
+		params = append(params, `error_description="`+quoteEscape(description)+`"`)
+	}
+	message := description
+	if message == "" {
+		message = "Unauthorized"
+	}
+	return WithHeader(New(http.StatusUnauthorized, message), "WWW-Authenticate", bearerChallenge(params))
+}
+
+// ForbiddenBearer creates a 403 Forbidden error with an RFC 6750 insufficient_scope challenge
+// listing the scope required to access the resource
+func ForbiddenBearer(scope string) HTTPError {
+	params := []string{`error="insufficient_scope"`}
+	if scope != "" {
+		params = append(params, `scope="`+quoteEscape(scope)+`"`)
+	}
+	return WithHeader(New(http.StatusForbidden, "Insufficient scope"), "WWW-Authenticate", bearerChallenge(params))
+}
+
+// ForbiddenNoPermission creates a 403 Forbidden error with the machine code
+// "permission_denied" for a caller that is authenticated but lacks the given scope or
+// permission. The scope is attached as the "scope" field when set.
+func ForbiddenNoPermission(scope string) HTTPError {
+	err := WithCode(New(http.StatusForbidden, "Permission denied"), "permission_denied")
+	if scope != "" {
+		err = WithField(err, "scope", scope)
+	}
+	return err
+}
+
+// AuthError returns the error for a request that failed authorization. An authenticated
+// caller gets ForbiddenNoPermission(scope). Otherwise the result is a 401 with a Bearer
+// challenge and the code "authentication_required" when the request carried no
+// Authorization header, or "invalid_credentials" when it carried rejected credentials.
+func AuthError(r *http.Request, authenticated bool, scope string) HTTPError {
+	if authenticated {
+		return ForbiddenNoPermission(scope)
+	}
+	if r.Header.Get("Authorization") == "" {
+		return WithCode(UnauthorizedBearer("", "Authentication required"), "authentication_required")
+	}
+	return WithCode(UnauthorizedBearer("invalid_token", "Invalid credentials"), "invalid_credentials")
+}
+
+func bearerChallenge(params []string) string {
+	if len(params) == 0 {
+		return "Bearer"
+	}
+	return "Bearer " + strings.Join(params, ", ")
+}
+
+// quoteEscape escapes backslashes and double quotes for use in a quoted-string
+func quoteEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\r", "", "\n", "").Replace(s)
+}
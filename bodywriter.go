@@ -0,0 +1,76 @@
+package httperror
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// BodyWriter serializes the error body. Status and headers are managed by the formatter.
+type BodyWriter func(w io.Writer, r *http.Request, err HTTPError) error
+
+var (
+	bodyWritersMu sync.RWMutex
+	bodyWriters   = map[string]BodyWriter{
+		"text/plain":       writePlainTextBody,
+		"application/json": writeJSONBody,
+		"text/html":        writeHTMLBody,
+	}
+)
+
+// RegisterBodyWriter registers a BodyWriter for a content type, replacing any existing one
+func RegisterBodyWriter(contentType string, bw BodyWriter) {
+	bodyWritersMu.Lock()
+	defer bodyWritersMu.Unlock()
+	bodyWriters[contentType] = bw
+}
+
+// LookupBodyWriter returns the BodyWriter registered for a content type
+func LookupBodyWriter(contentType string) (BodyWriter, bool) {
+	bodyWritersMu.RLock()
+	defer bodyWritersMu.RUnlock()
+	bw, ok := bodyWriters[contentType]
+	return bw, ok
+}
+
+// BodyWriterFormatter is a formatter that writes the body using the BodyWriter
+// registered for its content type
+type BodyWriterFormatter struct {
+	ContentType string
+}
+
+// NewBodyWriterFormatter creates a formatter for the given content type.
+// The BodyWriter is looked up at format time, falling back to plain text if none is registered.
+func NewBodyWriterFormatter(contentType string) *BodyWriterFormatter {
+	return &BodyWriterFormatter{ContentType: contentType}
+}
+
+// Format implements the Formatter interface
+func (f *BodyWriterFormatter) Format(w http.ResponseWriter, r *http.Request, err HTTPError) {
+	contentType := f.ContentType
+	bw, ok := LookupBodyWriter(contentType)
+	if !ok {
+		contentType, bw = "text/plain", writePlainTextBody
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(err.StatusCode())
+	bw(w, r, err)
+}
+
+func writePlainTextBody(w io.Writer, r *http.Request, err HTTPError) error {
+	_, werr := io.WriteString(w, err.Message())
+	return werr
+}
+
+func writeJSONBody(w io.Writer, r *http.Request, err HTTPError) error {
+	return (&JSONFormatter{}).writeBody(w, err)
+}
+
+func writeHTMLBody(w io.Writer, r *http.Request, err HTTPError) error {
+	title := html.EscapeString(fmt.Sprintf("%d %s", err.StatusCode(), statusText(err.StatusCode())))
+	_, werr := fmt.Fprintf(w, "<!DOCTYPE html>\n<html><head><title>%s</title></head><body><h1>%s</h1><p>%s</p></body></html>\n",
+		title, title, html.EscapeString(err.Message()))
+	return werr
+}
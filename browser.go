@@ -0,0 +1,37 @@
+package httperror
+
+import (
+	"net/http"
+	"strings"
+)
+
+// BrowserAwareFormatter returns a formatter that serves html to browser navigations and
+// api to everything else. A request counts as a browser navigation when it explicitly
+// accepts text/html and carries a Sec-Fetch-Mode of "navigate" or a Sec-Fetch-Dest of "document".
+func BrowserAwareFormatter(html Formatter, api Formatter) Formatter {
+	return FormatterFunc(func(w http.ResponseWriter, r *http.Request, err HTTPError) {
+		addVary(w.Header(), "Accept", "Sec-Fetch-Mode", "Sec-Fetch-Dest")
+		if isBrowserRequest(r) {
+			html.Format(w, r, err)
+			return
+		}
+		api.Format(w, r, err)
+	})
+}
+
+func isBrowserRequest(r *http.Request) bool {
+	if !strings.Contains(strings.ToLower(strings.Join(r.Header.Values("Accept"), ",")), "text/html") {
+		return false
+	}
+	return r.Header.Get("Sec-Fetch-Mode") == "navigate" || r.Header.Get("Sec-Fetch-Dest") == "document"
+}
+
+// NamedFormatter decorates a formatter so it reports its name in the X-Error-Formatter
+// header. Wrapping the branches of a dispatching formatter such as BrowserAwareFormatter
+// shows which one produced the body, which helps when debugging content negotiation.
+func NamedFormatter(name string, f Formatter) Formatter {
+	return FormatterFunc(func(w http.ResponseWriter, r *http.Request, err HTTPError) {
+		w.Header().Set("X-Error-Formatter", name)
+		f.Format(w, r, err)
+	})
+}
@@ -0,0 +1,70 @@
+package httperror
+
+import (
+	"net/http"
+)
+
+// Builder constructs an HTTPError through chained setters, e.g.
+//
+//	httperror.NewBuilder(404).Message("User not found").Code("user_not_found").Build()
+type Builder struct {
+	err *basicError
+}
+
+// NewBuilder creates a Builder for the given status code. The message defaults to the status text.
+// Codes outside 100-599 are logged and replaced with 500.
+func NewBuilder(code int) *Builder {
+	code = checkStatus(code)
+	return &Builder{
+		err: &basicError{
+			code:    code,
+			message: http.StatusText(code),
+			headers: make(map[string]string),
+		},
+	}
+}
+
+// Message sets the client-facing message
+func (b *Builder) Message(message string) *Builder {
+	b.err.message = message
+	return b
+}
+
+// Messagef sets the client-facing message with formatting
+func (b *Builder) Messagef(format string, args ...interface{}) *Builder {
+	b.err.message = sprintf(format, args...)
+	return b
+}
+
+// Header sets a response header, replacing one whose key differs only in case. Retry-After
+// is checked as in WithHeader.
+func (b *Builder) Header(key, value string) *Builder {
+	b.err.setHeader(key, value)
+	return b
+}
+
+// Code sets the machine-readable error code
+func (b *Builder) Code(code string) *Builder {
+	b.err.errCode = code
+	return b
+}
+
+// Field attaches a field
+func (b *Builder) Field(key string, value any) *Builder {
+	if b.err.fields == nil {
+		b.err.fields = make(map[string]any)
+	}
+	b.err.fields[key] = value
+	return b
+}
+
+// Cause sets the wrapped error
+func (b *Builder) Cause(err error) *Builder {
+	b.err.cause = err
+	return b
+}
+
+// Build returns the HTTPError. The Builder can be reused afterwards without affecting it.
+func (b *Builder) Build() HTTPError {
+	return b.err.clone()
+}
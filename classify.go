@@ -0,0 +1,60 @@
+package httperror
+
+import (
+	"net/http"
+)
+
+// Status classes returned by Classify
+const (
+	ClassInformational = "informational"
+	ClassSuccess       = "success"
+	ClassRedirect      = "redirect"
+	ClassClientError   = "client_error"
+	ClassServerError   = "server_error"
+)
+
+// Classify returns the status class, status code and retryability of an error.
+// Errors that are not HTTPErrors are classified as 500. A nil error returns ("", 0, false).
+func Classify(err error) (class string, code int, retryable bool) {
+	if err == nil {
+		return "", 0, false
+	}
+	code = AsHTTPError(err).StatusCode()
+	return statusClass(code), code, isRetryableStatus(code)
+}
+
+// IsRetryable reports whether the error's status code indicates that the request may be retried
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	return isRetryableStatus(AsHTTPError(err).StatusCode())
+}
+
+func statusClass(code int) string {
+	switch {
+	case code >= 100 && code < 200:
+		return ClassInformational
+	case code >= 200 && code < 300:
+		return ClassSuccess
+	case code >= 300 && code < 400:
+		return ClassRedirect
+	case code >= 400 && code < 500:
+		return ClassClientError
+	default:
+		return ClassServerError
+	}
+}
+
+func isRetryableStatus(code int) bool {
+	switch code {
+	case http.StatusRequestTimeout,
+		http.StatusTooEarly,
+		http.StatusTooManyRequests,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,8 @@
+package httperror
+
+import (
+	"time"
+)
+
+// nowFunc returns the current time. Tests replace it to get deterministic timestamps.
+var nowFunc = time.Now
@@ -0,0 +1,41 @@
+package httperror
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ANSI escape sequences used by ColorTextFormatter
+const (
+	ansiRed   = "\x1b[31m"
+	ansiReset = "\x1b[0m"
+)
+
+// ColorTextFormatter writes plain text errors with the status code colored red for
+// terminal clients. Color is only used when the request identifies itself as a CLI
+// with X-Client: cli; other requests get the same output as PlainTextFormatter.
+type ColorTextFormatter struct {
+	// MaxBodySize caps the message size as in PlainTextFormatter, in both modes
+	MaxBodySize int
+}
+
+// NewColorTextFormatter creates a ColorTextFormatter
+func NewColorTextFormatter() *ColorTextFormatter {
+	return &ColorTextFormatter{}
+}
+
+// Format implements the Formatter interface
+func (f *ColorTextFormatter) Format(w http.ResponseWriter, r *http.Request, err HTTPError) {
+	addVary(w.Header(), "X-Client")
+	if !strings.EqualFold(r.Header.Get("X-Client"), "cli") {
+		(&PlainTextFormatter{MaxBodySize: f.MaxBodySize}).Format(w, r, err)
+		return
+	}
+	// Escape characters in the message could otherwise drive the client's terminal
+	message := truncateBody(strings.ReplaceAll(err.Message(), "\x1b", ""), f.MaxBodySize)
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(err.StatusCode())
+	w.Write([]byte(ansiRed + strconv.Itoa(err.StatusCode()) + ansiReset + " " + message + "\n"))
+}
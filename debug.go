@@ -0,0 +1,94 @@
+package httperror
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// DefaultDebugRequestHeaders are the request headers echoed by a DebugFormatter by default
+var DefaultDebugRequestHeaders = []string{"Accept", "Content-Type", "User-Agent"}
+
+// DebugFormatter writes detailed JSON error responses for development use.
+// It should not be used in production since it exposes request details.
+type DebugFormatter struct {
+	// RequestHeaders lists the request headers echoed under "request_headers".
+	// Sensitive headers (see SetSensitiveHeaders) are left out even when listed.
+	RequestHeaders []string
+	// QueryParams lists the query parameters echoed under "query". Others are left out.
+	QueryParams []string
+}
+
+// NewDebugFormatter creates a DebugFormatter echoing DefaultDebugRequestHeaders
+func NewDebugFormatter() *DebugFormatter {
+	return &DebugFormatter{
+		RequestHeaders: DefaultDebugRequestHeaders,
+	}
+}
+
+// Format implements the Formatter interface
+func (f *DebugFormatter) Format(w http.ResponseWriter, r *http.Request, err HTTPError) {
+	f.FormatWithCause(w, r, err, nil)
+}
+
+// FormatWithCause implements the FormatterWithCause interface, adding the original error as "cause"
+func (f *DebugFormatter) FormatWithCause(w http.ResponseWriter, r *http.Request, err HTTPError, cause error) {
+	body := map[string]any{
+		"error":  err.Message(),
+		"status": err.StatusCode(),
+		"code":   statusText(err.StatusCode()),
+		"method": r.Method,
+		"path":   r.URL.Path,
+	}
+	if code := CodeOf(err); code != "" {
+		body["error_code"] = code
+	}
+	if fields := FieldsOf(err); fields != nil {
+		body["fields"] = fields
+	}
+	if details := DetailsOf(err); details != nil {
+		body["details"] = details
+	}
+	if cause != nil {
+		body["cause"] = cause.Error()
+	}
+	if headers := f.requestHeaders(r); len(headers) > 0 {
+		body["request_headers"] = headers
+	}
+	if query := f.query(r); len(query) > 0 {
+		body["query"] = query
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(err.StatusCode())
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(body)
+}
+
+// requestHeaders returns the allowlisted request headers present on r
+func (f *DebugFormatter) requestHeaders(r *http.Request) map[string]string {
+	headers := make(map[string]string)
+	for _, name := range f.RequestHeaders {
+		name = http.CanonicalHeaderKey(name)
+		if isSensitiveHeader(name) {
+			continue
+		}
+		if value := r.Header.Get(name); value != "" {
+			headers[name] = value
+		}
+	}
+	return headers
+}
+
+// query returns the allowlisted query parameters present on r
+func (f *DebugFormatter) query(r *http.Request) map[string]string {
+	values := r.URL.Query()
+	query := make(map[string]string)
+	for _, name := range f.QueryParams {
+		if v, ok := values[name]; ok {
+			query[name] = strings.Join(v, ",")
+		}
+	}
+	return query
+}
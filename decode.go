@@ -0,0 +1,131 @@
+package httperror
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MaxStrictJSONBodySize is the largest request body DecodeJSONStrict reads. Wrap the body
+// with http.MaxBytesReader for a lower limit.
+const MaxStrictJSONBodySize = 1 << 20
+
+// DecodeJSONStrict decodes the request body into v, rejecting unknown fields. Unlike
+// json.Decoder.DisallowUnknownFields, which stops at the first one, every unknown field
+// is reported in a single 400 with one FieldError per field. Nested objects, slices, arrays
+// and maps are checked too, with names such as "address.zip" or "items[0].bogus".
+// Malformed JSON is a plain 400 and bodies over MaxStrictJSONBodySize are a 413.
+func DecodeJSONStrict(r *http.Request, v any) HTTPError {
+	body, err := io.ReadAll(io.LimitReader(r.Body, MaxStrictJSONBodySize+1))
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesErr), err == nil && len(body) > MaxStrictJSONBodySize:
+		return Wrap(http.StatusRequestEntityTooLarge, "Request body too large", err)
+	case err != nil:
+		return Wrap(http.StatusBadRequest, "Failed to read request body", err)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return Wrap(http.StatusBadRequest, "Malformed JSON request body", err)
+	}
+
+	var unknown []string
+	collectUnknownFields(body, reflect.TypeOf(v), "", &unknown)
+	if len(unknown) == 0 {
+		return nil
+	}
+	sort.Strings(unknown)
+	fieldErrors := make([]FieldError, 0, len(unknown))
+	for _, name := range unknown {
+		fieldErrors = append(fieldErrors, FieldError{Field: name, Message: "unknown field"})
+	}
+	return ValidationError("Request body contains unknown fields", fieldErrors...)
+}
+
+// collectUnknownFields appends the names of keys in the JSON value data that do not map to
+// a struct field of t, descending into struct fields and slice, array and map elements
+func collectUnknownFields(data []byte, t reflect.Type, prefix string, unknown *[]string) {
+	for t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == nil {
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		var object map[string]json.RawMessage
+		if json.Unmarshal(data, &object) != nil {
+			return
+		}
+		known := jsonFields(t)
+		for key, raw := range object {
+			name := key
+			if prefix != "" {
+				name = prefix + "." + key
+			}
+			fieldType, ok := known[strings.ToLower(key)]
+			if !ok {
+				*unknown = append(*unknown, name)
+				continue
+			}
+			collectUnknownFields(raw, fieldType, name, unknown)
+		}
+	case reflect.Slice, reflect.Array:
+		var elements []json.RawMessage
+		if json.Unmarshal(data, &elements) != nil {
+			return
+		}
+		for i, raw := range elements {
+			collectUnknownFields(raw, t.Elem(), prefix+"["+strconv.Itoa(i)+"]", unknown)
+		}
+	case reflect.Map:
+		var object map[string]json.RawMessage
+		if json.Unmarshal(data, &object) != nil {
+			return
+		}
+		for key, raw := range object {
+			collectUnknownFields(raw, t.Elem(), prefix+"["+strconv.Quote(key)+"]", unknown)
+		}
+	}
+}
+
+// jsonFields returns the lowercased JSON names of t's fields, including promoted fields
+// of embedded structs, mapped to their types. encoding/json matches names case-insensitively.
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			embedded := f.Type
+			if embedded.Kind() == reflect.Pointer {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				for k, v := range jsonFields(embedded) {
+					if _, exists := fields[k]; !exists {
+						fields[k] = v
+					}
+				}
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[strings.ToLower(name)] = f.Type
+	}
+	return fields
+}
@@ -0,0 +1,69 @@
+package httperror
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// DryRunWriter is an http.ResponseWriter that records the status, headers and body
+// written to it instead of sending them anywhere
+type DryRunWriter struct {
+	Status int
+	Body   bytes.Buffer
+
+	header      http.Header
+	wroteHeader bool
+}
+
+// NewDryRunWriter creates an empty DryRunWriter
+func NewDryRunWriter() *DryRunWriter {
+	return &DryRunWriter{header: make(http.Header)}
+}
+
+// Header implements http.ResponseWriter
+func (d *DryRunWriter) Header() http.Header {
+	if d.header == nil {
+		d.header = make(http.Header)
+	}
+	return d.header
+}
+
+// WriteHeader implements http.ResponseWriter. Only the first call has an effect.
+func (d *DryRunWriter) WriteHeader(code int) {
+	if d.wroteHeader {
+		return
+	}
+	d.wroteHeader = true
+	d.Status = code
+}
+
+// Write implements http.ResponseWriter, recording an implicit 200 if no status was written
+func (d *DryRunWriter) Write(b []byte) (int, error) {
+	d.WriteHeader(http.StatusOK)
+	return d.Body.Write(b)
+}
+
+// flush copies the recorded headers, status and body to w
+func (d *DryRunWriter) flush(w http.ResponseWriter) {
+	for k, v := range d.header {
+		w.Header()[k] = v
+	}
+	if d.wroteHeader {
+		w.WriteHeader(d.Status)
+	}
+	if d.Body.Len() > 0 {
+		w.Write(d.Body.Bytes())
+	}
+}
+
+// SimulateError runs h as a Handler with the default formatter against r and returns what
+// would have been written, without a network connection. A handler that writes nothing
+// reports 200, as net/http would.
+func SimulateError(h HandlerFunc, r *http.Request) (status int, headers http.Header, body []byte) {
+	d := NewDryRunWriter()
+	NewHandler(h).ServeHTTP(d, r)
+	if !d.wroteHeader {
+		d.Status = http.StatusOK
+	}
+	return d.Status, d.Header(), d.Body.Bytes()
+}
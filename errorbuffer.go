@@ -0,0 +1,79 @@
+package httperror
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrorRecord describes an error served by a handler
+type ErrorRecord struct {
+	Time    time.Time
+	Status  int
+	Method  string
+	Path    string
+	Route   string // see RoutePattern
+	Message string
+}
+
+// ErrorBuffer is a fixed-size, thread-safe ring buffer of the most recent errors
+type ErrorBuffer struct {
+	mu      sync.Mutex
+	entries []ErrorRecord
+	next    int
+	full    bool
+}
+
+// NewErrorBuffer creates an ErrorBuffer holding at most n records
+func NewErrorBuffer(n int) *ErrorBuffer {
+	if n < 1 {
+		n = 1
+	}
+	return &ErrorBuffer{
+		entries: make([]ErrorRecord, n),
+	}
+}
+
+// Record stores an error, evicting the oldest record when the buffer is full
+func (b *ErrorBuffer) Record(r *http.Request, err HTTPError) {
+	rec := ErrorRecord{
+		Time:    nowFunc(),
+		Status:  err.StatusCode(),
+		Message: err.Message(),
+	}
+	if r != nil {
+		rec.Method = r.Method
+		rec.Path = r.URL.Path
+		rec.Route = RoutePattern(r)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.entries[b.next] = rec
+	b.next = (b.next + 1) % len(b.entries)
+	if b.next == 0 {
+		b.full = true
+	}
+}
+
+// Entries returns a copy of the stored records, oldest first
+func (b *ErrorBuffer) Entries() []ErrorRecord {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.full {
+		return append([]ErrorRecord(nil), b.entries[:b.next]...)
+	}
+	out := make([]ErrorRecord, 0, len(b.entries))
+	out = append(out, b.entries[b.next:]...)
+	return append(out, b.entries[:b.next]...)
+}
+
+// ServeHTTP implements http.Handler, writing the stored records as plain text for debug endpoints
+func (b *ErrorBuffer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	for _, rec := range b.Entries() {
+		fmt.Fprintf(w, "%s %d %s %s %s\n", rec.Time.Format(time.RFC3339), rec.Status, rec.Method, rec.Path, rec.Message)
+	}
+}
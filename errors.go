@@ -7,6 +7,11 @@ import (
 
 // Common HTTP errors
 
+// MovedPermanently creates a 301 Moved Permanently response redirecting to location
+func MovedPermanently(location string) HTTPError {
+	return WithHeader(New(http.StatusMovedPermanently, "Moved Permanently"), "Location", location)
+}
+
 // BadRequest creates a 400 Bad Request error
 func BadRequest(message string) HTTPError {
 	return New(http.StatusBadRequest, message)
@@ -43,16 +48,55 @@ func MethodNotAllowed(message string) HTTPError {
 	return New(http.StatusMethodNotAllowed, message)
 }
 
+// NotAcceptable creates a 406 Not Acceptable error
+func NotAcceptable(message string) HTTPError {
+	if message == "" {
+		message = "Not Acceptable"
+	}
+	return New(http.StatusNotAcceptable, message)
+}
+
+// RequestTimeout creates a 408 Request Timeout error for when the client's request itself
+// took too long, as opposed to an upstream timing out
+func RequestTimeout(message string) HTTPError {
+	if message == "" {
+		message = "Request Timeout"
+	}
+	return New(http.StatusRequestTimeout, message)
+}
+
 // Conflict creates a 409 Conflict error
 func Conflict(message string) HTTPError {
 	return New(http.StatusConflict, message)
 }
 
+// Gone creates a 410 Gone error for resources that were removed permanently
+func Gone(message string) HTTPError {
+	if message == "" {
+		message = "Gone"
+	}
+	return New(http.StatusGone, message)
+}
+
+// MisdirectedRequest creates a 421 Misdirected Request error
+func MisdirectedRequest(message string) HTTPError {
+	if message == "" {
+		message = "Misdirected Request"
+	}
+	return New(http.StatusMisdirectedRequest, message)
+}
+
 // UnprocessableEntity creates a 422 Unprocessable Entity error
 func UnprocessableEntity(message string) HTTPError {
 	return New(http.StatusUnprocessableEntity, message)
 }
 
+// IdempotencyKeyRequired creates a 428 Precondition Required error with the machine code
+// "idempotency_key_required" for write endpoints called without an Idempotency-Key header
+func IdempotencyKeyRequired() HTTPError {
+	return WithCode(New(http.StatusPreconditionRequired, "An Idempotency-Key header is required"), "idempotency_key_required")
+}
+
 // InternalServerError creates a 500 Internal Server Error
 func InternalServerError(message string) HTTPError {
 	if message == "" {
@@ -66,6 +110,16 @@ func InternalServerErrorf(format string, args ...interface{}) HTTPError {
 	return New(http.StatusInternalServerError, sprintf(format, args...))
 }
 
+// InternalWithSupport creates a generic 500 Internal Server Error pointing clients to a
+// support page. The URL is part of the message and attached as the "support_url" field.
+// The real cause should be logged by the caller and never passed here.
+func InternalWithSupport(supportURL string) HTTPError {
+	return WithField(
+		New(http.StatusInternalServerError, "An unexpected error occurred. If the problem persists, contact support: "+supportURL),
+		"support_url", supportURL,
+	)
+}
+
 // NotImplemented creates a 501 Not Implemented error
 func NotImplemented(message string) HTTPError {
 	if message == "" {
@@ -98,6 +152,12 @@ func GatewayTimeout(message string) HTTPError {
 	return New(http.StatusGatewayTimeout, message)
 }
 
+// UpstreamTimeout creates a 504 Gateway Timeout error recording which upstream timed out
+// in the "upstream" field, with the machine code "upstream_timeout"
+func UpstreamTimeout(upstream string) HTTPError {
+	return WithField(WithCode(GatewayTimeout(""), "upstream_timeout"), "upstream", upstream)
+}
+
 // sprintf is a helper to format strings
 func sprintf(format string, args ...interface{}) string {
 	return fmt.Sprintf(format, args...)
@@ -18,7 +18,7 @@ func main() {
 
 	// Example 1: Default formatter (simple plain text)
 	mux.Handle("/users", httperror.NewHandler(listUsers))
-	mux.Handle("/users/", httperror.NewHandler(getUser))
+	mux.Handle("/users/{id}", httperror.NewHandler(getUser))
 
 	// Example 2: Custom JSON formatter
 	jsonFormatter := &JSONFormatter{}
@@ -78,17 +78,9 @@ func getUser(w http.ResponseWriter, r *http.Request) error {
 		return httperror.MethodNotAllowed("")
 	}
 
-	// Extract ID from path
-	path := r.URL.Path
-	idStr := path[len("/users/"):]
-
-	if idStr == "" {
-		return httperror.BadRequest("User ID is required")
-	}
-
-	id, err := strconv.Atoi(idStr)
+	id, err := httperror.PathInt(r, "id")
 	if err != nil {
-		return httperror.BadRequest("Invalid user ID format")
+		return err
 	}
 
 	user, exists := users[id]
@@ -0,0 +1,182 @@
+package httperror
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// WithCode attaches a machine-readable error code such as "user_not_found".
+// A nil error is returned as nil.
+func WithCode(err HTTPError, code string) HTTPError {
+	if err == nil {
+		return nil
+	}
+	c := toBasic(err)
+	c.errCode = code
+	return c
+}
+
+// CodeOf returns the machine-readable code attached to an error, or "" if none
+func CodeOf(err error) string {
+	var coder interface{ Code() string }
+	if errors.As(err, &coder) {
+		return coder.Code()
+	}
+	return ""
+}
+
+// WithCategory tags an error with a free-form category such as "auth" or "db" for grouping
+// in logs and stats. The category is never sent to clients. A nil error is returned as nil.
+func WithCategory(err HTTPError, category string) HTTPError {
+	if err == nil {
+		return nil
+	}
+	c := toBasic(err)
+	c.category = category
+	return c
+}
+
+// CategoryOf returns the category attached to an error, or "" if none
+func CategoryOf(err error) string {
+	var categorizer interface{ Category() string }
+	if errors.As(err, &categorizer) {
+		return categorizer.Category()
+	}
+	return ""
+}
+
+// WithField attaches a single field to an error
+func WithField(err HTTPError, key string, value any) HTTPError {
+	return WithFields(err, map[string]any{key: value})
+}
+
+// WithFields attaches fields to an error, overwriting existing fields with the same key.
+// A nil error is returned as nil.
+func WithFields(err HTTPError, fields map[string]any) HTTPError {
+	if err == nil {
+		return nil
+	}
+	c := toBasic(err)
+	if c.fields == nil {
+		c.fields = make(map[string]any, len(fields))
+	}
+	for k, v := range fields {
+		c.fields[k] = v
+	}
+	return c
+}
+
+// FieldsOf returns a copy of the fields attached to an error, or nil if none
+func FieldsOf(err error) map[string]any {
+	var fielder interface{ Fields() map[string]any }
+	if !errors.As(err, &fielder) {
+		return nil
+	}
+	fields := fielder.Fields()
+	if len(fields) == 0 {
+		return nil
+	}
+	out := make(map[string]any, len(fields))
+	for k, v := range fields {
+		out[k] = v
+	}
+	return out
+}
+
+// WithPublicFields attaches fields that are safe to send to clients. It is the same as
+// WithFields and is provided to make the distinction from WithInternalFields explicit.
+func WithPublicFields(err HTTPError, fields map[string]any) HTTPError {
+	return WithFields(err, fields)
+}
+
+// WithInternalFields attaches fields meant for logs only. Formatters never serialize
+// them; use InternalFieldsOf in logging hooks. A nil error is returned as nil.
+func WithInternalFields(err HTTPError, fields map[string]any) HTTPError {
+	if err == nil {
+		return nil
+	}
+	c := toBasic(err)
+	if c.internalFields == nil {
+		c.internalFields = make(map[string]any, len(fields))
+	}
+	for k, v := range fields {
+		c.internalFields[k] = v
+	}
+	return c
+}
+
+// InternalFieldsOf returns a copy of the internal fields attached to an error, or nil if none
+func InternalFieldsOf(err error) map[string]any {
+	var fielder interface{ InternalFields() map[string]any }
+	if !errors.As(err, &fielder) {
+		return nil
+	}
+	fields := fielder.InternalFields()
+	if len(fields) == 0 {
+		return nil
+	}
+	out := make(map[string]any, len(fields))
+	for k, v := range fields {
+		out[k] = v
+	}
+	return out
+}
+
+// WithDetails attaches structured detail objects, such as gRPC-style typed detail
+// messages, appending to any already attached. JSON formatters serialize them under
+// "details". A nil error is returned as nil.
+func WithDetails(err HTTPError, details ...any) HTTPError {
+	if err == nil {
+		return nil
+	}
+	c := toBasic(err)
+	c.details = append(c.details, details...)
+	return c
+}
+
+// DetailsOf returns the details attached to an error, or nil if none
+func DetailsOf(err error) []any {
+	var d interface{ Details() []any }
+	if !errors.As(err, &d) || len(d.Details()) == 0 {
+		return nil
+	}
+	return append([]any(nil), d.Details()...)
+}
+
+// FieldsAsHeaders decorates a formatter so the error's machine code and fields are
+// also written as response headers named {prefix}Code and {prefix}{Key}
+func FieldsAsHeaders(base Formatter, prefix string) Formatter {
+	if base == nil {
+		base = &PlainTextFormatter{}
+	}
+	return FormatterFunc(func(w http.ResponseWriter, r *http.Request, err HTTPError) {
+		if code := CodeOf(err); code != "" {
+			w.Header().Set(sanitizeHeaderKey(prefix+"Code"), sanitizeHeaderValue(code))
+		}
+		for k, v := range FieldsOf(err) {
+			w.Header().Set(sanitizeHeaderKey(prefix+k), sanitizeHeaderValue(sprintf("%v", v)))
+		}
+		base.Format(w, r, err)
+	})
+}
+
+// sanitizeHeaderKey replaces characters not allowed in header names with '-'
+func sanitizeHeaderKey(key string) string {
+	return http.CanonicalHeaderKey(strings.Map(func(r rune) rune {
+		if r < 0x80 && (r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || strings.ContainsRune("!#$%&'*+-.^_`|~", r)) {
+			return r
+		}
+		return '-'
+	}, key))
+}
+
+// sanitizeHeaderValue removes control characters so values cannot inject headers
+func sanitizeHeaderValue(value string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 && r != '\t' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, value)
+}
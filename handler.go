@@ -1,112 +1,401 @@
 package httperror
 
 import (
+	"context"
+	"errors"
 	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
 )
 
+// DefaultPlainTextMaxBodySize is the body size cap used by PlainTextFormatter when MaxBodySize is zero
+const DefaultPlainTextMaxBodySize = 64 << 10
+
+// truncatedNotice is appended to plain text bodies that exceed the size cap
+const truncatedNotice = "... (truncated)"
+
 // PlainTextFormatter is a simple formatter that returns plain text error messages
-type PlainTextFormatter struct{}
+type PlainTextFormatter struct {
+	// MaxBodySize caps the body size in bytes. Longer messages are truncated with a notice.
+	// Zero means DefaultPlainTextMaxBodySize, a negative value disables the cap.
+	MaxBodySize int
+}
 
 // Format implements Formatter interface for plain text responses
 func (f *PlainTextFormatter) Format(w http.ResponseWriter, r *http.Request, err HTTPError) {
 	w.Header().Set("Content-Type", "text/plain")
 	w.WriteHeader(err.StatusCode())
-	w.Write([]byte(err.Message()))
+	w.Write([]byte(truncateBody(err.Message(), f.MaxBodySize)))
+}
+
+// CodedPlainTextFormatter is a plain text formatter that prefixes the machine code
+// in brackets when present, e.g. "[user_not_found] User not found"
+type CodedPlainTextFormatter struct {
+	// MaxBodySize caps the body size as in PlainTextFormatter
+	MaxBodySize int
+}
+
+// Format implements Formatter interface for plain text responses
+func (f *CodedPlainTextFormatter) Format(w http.ResponseWriter, r *http.Request, err HTTPError) {
+	message := err.Message()
+	if code := CodeOf(err); code != "" {
+		message = "[" + code + "] " + message
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(err.StatusCode())
+	w.Write([]byte(truncateBody(message, f.MaxBodySize)))
+}
+
+// truncateBody shortens s to at most max bytes, ending with truncatedNotice,
+// without splitting a UTF-8 sequence
+func truncateBody(s string, max int) string {
+	if max == 0 {
+		max = DefaultPlainTextMaxBodySize
+	}
+	if max < 0 || len(s) <= max {
+		return s
+	}
+	cut := max - len(truncatedNotice)
+	if cut < 0 {
+		cut = 0
+	}
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut] + truncatedNotice
+}
+
+// Option configures a Handler or ContextHandler
+type Option func(*options)
+
+// options holds the optional configuration shared by Handler and ContextHandler
+type options struct {
+	errorBuffer *ErrorBuffer
+	onPanic     func(r *http.Request, recovered any, stack []byte)
+	onError     func(r *http.Request, err HTTPError)
+	on5xx       func(r *http.Request, err HTTPError)
+
+	// exposeServerErrors disables sanitization of errors that are not HTTPErrors
+	exposeServerErrors bool
+
+	// selectFormatter picks the formatter per request, nil to use the handler's formatter
+	selectFormatter func(r *http.Request) Formatter
+
+	// codeHeader emits the machine code as X-Error-Code
+	codeHeader bool
+
+	// serverTiming is the metric name used for the Server-Timing header, empty if disabled
+	serverTiming string
+}
+
+func newOptions(opts []Option) options {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithErrorBuffer keeps the last n errors served by the handler in memory.
+// The buffer is available through the handler's ErrorBuffer method.
+func WithErrorBuffer(n int) Option {
+	return func(o *options) {
+		if n > 0 {
+			o.errorBuffer = NewErrorBuffer(n)
+		}
+	}
+}
+
+// OnPanic registers a callback invoked with the recovered value and stack when the
+// handler panics. The stack starts at the panicking frame; recovery frames are trimmed.
+func OnPanic(fn func(r *http.Request, recovered any, stack []byte)) Option {
+	return func(o *options) {
+		o.onPanic = fn
+	}
+}
+
+// OnError registers a callback invoked for every error the handler writes
+func OnError(fn func(r *http.Request, err HTTPError)) Option {
+	return func(o *options) {
+		o.onError = fn
+	}
+}
+
+// On5xx registers a callback invoked only for server errors (status >= 500),
+// including recovered panics
+func On5xx(fn func(r *http.Request, err HTTPError)) Option {
+	return func(o *options) {
+		o.on5xx = fn
+	}
+}
+
+// WithSanitizeServerErrors controls whether errors that are not HTTPErrors are replaced
+// by a generic 500 message (the default). Disabling it sends err.Error() to the client,
+// which should only be done on trusted internal routes.
+func WithSanitizeServerErrors(sanitize bool) Option {
+	return func(o *options) {
+		o.exposeServerErrors = !sanitize
+	}
+}
+
+// WithServerTiming adds a Server-Timing header to error responses reporting the time spent
+// in the handler under the given metric name, e.g. "app;dur=12.3" (milliseconds)
+func WithServerTiming(name string) Option {
+	return func(o *options) {
+		o.serverTiming = name
+	}
+}
+
+// WithErrorCodeHeader sends the error's machine code (see WithCode) in an X-Error-Code
+// header, for clients that would rather not parse the body. Errors without a code get no header.
+func WithErrorCodeHeader() Option {
+	return func(o *options) {
+		o.codeHeader = true
+	}
+}
+
+// WithFormatterSelector chooses the formatter for each error response, e.g. from a feature
+// flag during the rollout of a new error format. When fn returns nil, the handler's own
+// formatter is used.
+func WithFormatterSelector(fn func(r *http.Request) Formatter) Option {
+	return func(o *options) {
+		o.selectFormatter = fn
+	}
+}
+
+// requestState is per-request data shared between a Handler, the middleware it runs and
+// its formatter. Formatters receive the request as the Handler saw it, so values that
+// middleware would add to a derived context are recorded here instead.
+type requestState struct {
+	start     time.Time
+	requestID string
+}
+
+type requestStateKey struct{}
+
+// withRequestState attaches a new requestState to the request's context
+func withRequestState(r *http.Request, opts *options) *http.Request {
+	st := &requestState{}
+	if opts.serverTiming != "" {
+		st.start = nowFunc()
+	}
+	return r.WithContext(context.WithValue(r.Context(), requestStateKey{}, st))
+}
+
+// requestStateOf returns the requestState of the request's Handler, or nil
+func requestStateOf(ctx context.Context) *requestState {
+	st, _ := ctx.Value(requestStateKey{}).(*requestState)
+	return st
+}
+
+// serverTimingValue returns the Server-Timing header value for the request, or "" if its
+// start time was not recorded
+func serverTimingValue(r *http.Request, name string) string {
+	st := requestStateOf(r.Context())
+	if st == nil || st.start.IsZero() {
+		return ""
+	}
+	ms := float64(nowFunc().Sub(st.start)) / float64(time.Millisecond)
+	return name + ";dur=" + strconv.FormatFloat(ms, 'f', 1, 64)
 }
 
 // Handler wraps a HandlerFunc to implement http.Handler
 type Handler struct {
 	handler   HandlerFunc
 	formatter Formatter
+	opts      options
 }
 
-// NewHandler creates a new Handler with default formatter
-func NewHandler(h HandlerFunc) *Handler {
+// NewHandler creates a new Handler with default formatter. Middleware registered with Use
+// is applied to h.
+func NewHandler(h HandlerFunc, opts ...Option) *Handler {
 	return &Handler{
-		handler:   h,
+		handler:   applyGlobalMiddleware(h),
 		formatter: &PlainTextFormatter{},
+		opts:      newOptions(opts),
 	}
 }
 
 // NewHandlerWithFormatter creates a new Handler with custom formatter
-func NewHandlerWithFormatter(h HandlerFunc, formatter Formatter) *Handler {
+func NewHandlerWithFormatter(h HandlerFunc, formatter Formatter, opts ...Option) *Handler {
 	return &Handler{
-		handler:   h,
+		handler:   applyGlobalMiddleware(h),
 		formatter: formatter,
+		opts:      newOptions(opts),
 	}
 }
 
 // ServeHTTP implements http.Handler
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r = withRequestState(r, &h.opts)
+	defer recoverPanic(w, r, &h.opts, h.handleError)
 	err := h.handler(w, r)
 	if err != nil {
 		h.handleError(w, r, err)
 	}
 }
 
-func (h *Handler) handleError(w http.ResponseWriter, r *http.Request, err error) {
-	// Convert to HTTPError
-	httpErr := AsHTTPError(err)
-
-	// Set headers
-	for key, value := range httpErr.Headers() {
-		w.Header().Set(key, value)
-	}
+// ErrorBuffer returns the handler's error buffer, or nil if WithErrorBuffer was not used
+func (h *Handler) ErrorBuffer() *ErrorBuffer {
+	return h.opts.errorBuffer
+}
 
-	// Format and write the error response
-	if h.formatter != nil {
-		h.formatter.Format(w, r, httpErr)
-	} else {
-		// Fallback to basic text response
-		w.WriteHeader(httpErr.StatusCode())
-		w.Write([]byte(httpErr.Message()))
-	}
+func (h *Handler) handleError(w http.ResponseWriter, r *http.Request, err error) {
+	writeError(w, r, err, h.formatter, &h.opts)
 }
 
-// ContextHandler wraps a ContextHandlerFunc to implement http.Handler
+// ContextHandler wraps a ContextHandlerFunc to implement http.Handler.
+// An error that is not an HTTPError, returned after the request context's deadline passed,
+// is reported as 504 Gateway Timeout. So is nil, unless the handler has already written
+// a response.
 type ContextHandler struct {
 	handler   ContextHandlerFunc
 	formatter Formatter
+	opts      options
 }
 
 // NewContextHandler creates a new ContextHandler with default formatter
-func NewContextHandler(h ContextHandlerFunc) *ContextHandler {
+func NewContextHandler(h ContextHandlerFunc, opts ...Option) *ContextHandler {
 	return &ContextHandler{
-		handler:   h,
+		handler:   applyGlobalMiddlewareContext(h),
 		formatter: &PlainTextFormatter{},
+		opts:      newOptions(opts),
 	}
 }
 
 // NewContextHandlerWithFormatter creates a new ContextHandler with custom formatter
-func NewContextHandlerWithFormatter(h ContextHandlerFunc, formatter Formatter) *ContextHandler {
+func NewContextHandlerWithFormatter(h ContextHandlerFunc, formatter Formatter, opts ...Option) *ContextHandler {
 	return &ContextHandler{
-		handler:   h,
+		handler:   applyGlobalMiddlewareContext(h),
 		formatter: formatter,
+		opts:      newOptions(opts),
 	}
 }
 
 // ServeHTTP implements http.Handler
 func (h *ContextHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r = withRequestState(r, &h.opts)
+	var tracker *writeTracker
+	if _, ok := r.Context().Deadline(); ok {
+		tracker = &writeTracker{ResponseWriter: w}
+		w = tracker
+	}
+	defer recoverPanic(w, r, &h.opts, h.handleError)
 	err := h.handler(r.Context(), w, r)
+	if err == nil && tracker != nil && !tracker.written && errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+		// The handler gave up without responding
+		err = r.Context().Err()
+	}
 	if err != nil {
 		h.handleError(w, r, err)
 	}
 }
 
+// writeTracker records whether a final response has been started
+type writeTracker struct {
+	http.ResponseWriter
+	written bool
+}
+
+// WriteHeader implements http.ResponseWriter. Informational statuses do not count as a response.
+func (t *writeTracker) WriteHeader(code int) {
+	if code >= 200 {
+		t.written = true
+	}
+	t.ResponseWriter.WriteHeader(code)
+}
+
+// Write implements http.ResponseWriter
+func (t *writeTracker) Write(b []byte) (int, error) {
+	t.written = true
+	return t.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher when the underlying writer supports flushing
+func (t *writeTracker) Flush() {
+	t.written = true
+	http.NewResponseController(t.ResponseWriter).Flush()
+}
+
+// Unwrap returns the underlying writer for http.ResponseController
+func (t *writeTracker) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
+
+// ErrorBuffer returns the handler's error buffer, or nil if WithErrorBuffer was not used
+func (h *ContextHandler) ErrorBuffer() *ErrorBuffer {
+	return h.opts.errorBuffer
+}
+
 func (h *ContextHandler) handleError(w http.ResponseWriter, r *http.Request, err error) {
+	// Report a generic error returned after the deadline passed as a timeout
+	if _, ok := err.(HTTPError); !ok && !errors.Is(err, ErrResponseWritten) &&
+		errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+		err = Wrap(http.StatusGatewayTimeout, "Gateway Timeout", err)
+	}
+	writeError(w, r, err, h.formatter, &h.opts)
+}
+
+// writeError converts err to an HTTPError and writes it using the formatter
+func writeError(w http.ResponseWriter, r *http.Request, err error, formatter Formatter, opts *options) {
+	if errors.Is(err, ErrResponseWritten) {
+		return
+	}
+
 	// Convert to HTTPError
 	httpErr := AsHTTPError(err)
+	if _, ok := err.(HTTPError); !ok && opts.exposeServerErrors {
+		httpErr = Wrap(http.StatusInternalServerError, err.Error(), err)
+	}
 
-	// Set headers
-	for key, value := range httpErr.Headers() {
+	// Custom HTTPError implementations may carry codes WriteHeader would reject
+	if !validStatus(httpErr.StatusCode()) {
+		logger().Error("httperror: invalid status code, using 500", "status", httpErr.StatusCode())
+		httpErr = Wrap(http.StatusInternalServerError, "Internal Server Error", httpErr)
+	}
+
+	countError(httpErr)
+	if opts.errorBuffer != nil {
+		opts.errorBuffer.Record(r, httpErr)
+	}
+	if opts.onError != nil {
+		opts.onError(r, httpErr)
+	}
+	if opts.on5xx != nil && httpErr.StatusCode() >= 500 {
+		opts.on5xx(r, httpErr)
+	}
+
+	// Headers the handler set before returning the error are kept. A header carried
+	// by the error replaces the handler's value for the same key.
+	for key, value := range HeadersOf(httpErr) {
 		w.Header().Set(key, value)
 	}
+	if opts.codeHeader {
+		if code := CodeOf(httpErr); code != "" {
+			w.Header().Set("X-Error-Code", sanitizeHeaderValue(code))
+		}
+	}
+	if opts.serverTiming != "" {
+		if timing := serverTimingValue(r, opts.serverTiming); timing != "" {
+			w.Header().Add("Server-Timing", timing)
+		}
+	}
+
+	if opts.selectFormatter != nil {
+		if selected := opts.selectFormatter(r); selected != nil {
+			formatter = selected
+		}
+	}
 
 	// Format and write the error response
-	if h.formatter != nil {
-		h.formatter.Format(w, r, httpErr)
+	if fc, ok := formatter.(FormatterWithCause); ok {
+		fc.FormatWithCause(w, r, httpErr, err)
+	} else if formatter != nil {
+		formatter.Format(w, r, httpErr)
 	} else {
 		// Fallback to basic text response
+		w.Header().Set("Content-Type", "text/plain")
 		w.WriteHeader(httpErr.StatusCode())
 		w.Write([]byte(httpErr.Message()))
 	}
@@ -133,3 +422,14 @@ func HandleContext(pattern string, mux *http.ServeMux, handler ContextHandlerFun
 func HandleContextFunc(pattern string, handler ContextHandlerFunc) {
 	http.Handle(pattern, NewContextHandler(handler))
 }
+
+// AsHandler returns an http.Handler that always responds with err, e.g. to mount a 410 Gone
+// on a removed route. A nil formatter writes plain text.
+func AsHandler(err HTTPError, formatter Formatter, opts ...Option) http.Handler {
+	if formatter == nil {
+		formatter = &PlainTextFormatter{}
+	}
+	return NewHandlerWithFormatter(func(w http.ResponseWriter, r *http.Request) error {
+		return err
+	}, formatter, opts...)
+}
@@ -0,0 +1,140 @@
+package httperror
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// WithContentDisposition marks the error response as a downloadable attachment with the
+// given filename. Non-ASCII filenames are additionally sent as an RFC 6266 filename*
+// parameter. A nil error is returned as nil.
+func WithContentDisposition(err HTTPError, filename string) HTTPError {
+	fallback := strings.Map(func(r rune) rune {
+		if r < 0x20 || r >= 0x7f {
+			return '_'
+		}
+		return r
+	}, filename)
+
+	value := `attachment; filename="` + quoteEscape(fallback) + `"`
+	if fallback != filename {
+		value += "; filename*=UTF-8''" + url.PathEscape(filename)
+	}
+	return WithHeader(err, "Content-Disposition", value)
+}
+
+// strictHeaders is set with SetStrictHeaders
+var strictHeaders atomic.Bool
+
+// SetStrictHeaders controls what happens when a header is attached to an error whose status
+// it does not apply to, such as Retry-After on a 404. By default a warning is logged and the
+// header is kept; in strict mode the header is dropped.
+func SetStrictHeaders(strict bool) {
+	strictHeaders.Store(strict)
+}
+
+// WithRetryAfter sets the Retry-After header to the delay in whole seconds, rounded up.
+// Retry-After only applies to redirects and retryable statuses such as 429 and 503; see
+// SetStrictHeaders for other statuses. The same checks apply to Retry-After values set
+// with WithHeader, WithHeaders or Builder.Header, which must already be formatted.
+// A nil error is returned as nil.
+func WithRetryAfter(err HTTPError, d time.Duration) HTTPError {
+	if err == nil {
+		return nil
+	}
+	seconds := int64(math.Ceil(d.Seconds()))
+	if seconds < 0 {
+		seconds = 0
+	}
+	return WithHeader(err, "Retry-After", strconv.FormatInt(seconds, 10))
+}
+
+// retryAfterApplies reports whether Retry-After is meaningful for a status: redirects and
+// retryable statuses
+func retryAfterApplies(status int) bool {
+	return isRetryableStatus(status) || (status >= 300 && status < 400)
+}
+
+// validRetryAfter reports whether value is acceptable for the header key. Retry-After must
+// be delay-seconds or an HTTP-date; other headers are not checked.
+func validRetryAfter(key, value string) bool {
+	if !strings.EqualFold(key, "Retry-After") {
+		return true
+	}
+	if value != "" && strings.Trim(value, "0123456789") == "" {
+		return true
+	}
+	_, err := http.ParseTime(value)
+	return err == nil
+}
+
+// DeadlineAware sets Retry-After on err based on the time remaining until the context's
+// deadline, with a minimum of one second. Errors for contexts without a deadline are
+// returned unchanged.
+func DeadlineAware(ctx context.Context, err HTTPError) HTTPError {
+	deadline, ok := ctx.Deadline()
+	if !ok || err == nil {
+		return err
+	}
+	remaining := deadline.Sub(nowFunc())
+	if remaining < time.Second {
+		remaining = time.Second
+	}
+	return WithRetryAfter(err, remaining)
+}
+
+// WithConnectionClose sets Connection: close so the server closes the connection after
+// writing the error, e.g. when protocol abuse is detected. A nil error is returned as nil.
+func WithConnectionClose(err HTTPError) HTTPError {
+	return WithHeader(err, "Connection", "close")
+}
+
+// WithPreload adds a Link preload hint, e.g. `</css/error.css>; rel=preload; as=style`,
+// so browsers can fetch resources used by an HTML error page early. Repeated calls
+// append to the Link header. A nil error is returned as nil.
+func WithPreload(err HTTPError, href, asType string) HTTPError {
+	if err == nil {
+		return nil
+	}
+	link := "<" + sanitizeHeaderValue(href) + ">; rel=preload"
+	if asType != "" {
+		link += "; as=" + sanitizeHeaderValue(asType)
+	}
+	for k, v := range HeadersOf(err) {
+		if strings.EqualFold(k, "Link") && v != "" {
+			link = v + ", " + link
+		}
+	}
+	return WithHeader(err, "Link", link)
+}
+
+// WithExpires sets the Expires header to t as an HTTP-date, for CDNs that cache
+// errors based on Expires rather than Cache-Control. A nil error is returned as nil.
+func WithExpires(err HTTPError, t time.Time) HTTPError {
+	return WithHeader(err, "Expires", t.UTC().Format(http.TimeFormat))
+}
+
+// WithHSTS decorates a formatter so error responses to requests received over TLS carry
+// Strict-Transport-Security with the given max-age. Browsers ignore the header on plaintext
+// connections, so it is not sent there. A nil base means PlainTextFormatter.
+func WithHSTS(base Formatter, maxAge time.Duration, includeSubdomains bool) Formatter {
+	if base == nil {
+		base = &PlainTextFormatter{}
+	}
+	value := "max-age=" + strconv.FormatInt(int64(maxAge/time.Second), 10)
+	if includeSubdomains {
+		value += "; includeSubDomains"
+	}
+	return FormatterFunc(func(w http.ResponseWriter, r *http.Request, err HTTPError) {
+		if r.TLS != nil {
+			w.Header().Set("Strict-Transport-Security", value)
+		}
+		base.Format(w, r, err)
+	})
+}
@@ -0,0 +1,118 @@
+package httperror
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"path"
+	"sync"
+)
+
+// HTMLTemplateData is the template data used by HTMLTemplateFormatter when no data provider is set
+type HTMLTemplateData struct {
+	Status     int
+	StatusText string
+	Message    string
+	Code       string
+}
+
+// HTMLTemplateFormatter renders errors with an html/template
+type HTMLTemplateFormatter struct {
+	tmpl *template.Template
+	data func(r *http.Request, err HTTPError) any
+}
+
+// NewHTMLTemplateFormatter creates a formatter executing tmpl for every error. The data
+// provider's result is passed to the template, allowing dynamic content such as the request
+// ID or support links. If data is nil, the template receives an HTMLTemplateData.
+func NewHTMLTemplateFormatter(tmpl *template.Template, data func(r *http.Request, err HTTPError) any) *HTMLTemplateFormatter {
+	if data == nil {
+		data = defaultHTMLTemplateData
+	}
+	return &HTMLTemplateFormatter{
+		tmpl: tmpl,
+		data: data,
+	}
+}
+
+// Format implements the Formatter interface. If the template fails to execute,
+// the built-in HTML body is written instead.
+func (f *HTMLTemplateFormatter) Format(w http.ResponseWriter, r *http.Request, err HTTPError) {
+	var buf bytes.Buffer
+	if execErr := f.tmpl.Execute(&buf, f.data(r, err)); execErr != nil {
+		buf.Reset()
+		writeHTMLBody(&buf, r, err)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(err.StatusCode())
+	w.Write(buf.Bytes())
+}
+
+func defaultHTMLTemplateData(r *http.Request, err HTTPError) any {
+	return HTMLTemplateData{
+		Status:     err.StatusCode(),
+		StatusText: statusText(err.StatusCode()),
+		Message:    err.Message(),
+		Code:       CodeOf(err),
+	}
+}
+
+// EmbeddedHTMLFormatter serves static HTML error pages from a file system such as an embed.FS
+type EmbeddedHTMLFormatter struct {
+	fsys    fs.FS
+	pattern string
+	cache   sync.Map // status code -> []byte, nil if there is no page
+}
+
+// NewEmbeddedHTMLFormatter creates a formatter serving the page named by pattern, a format
+// string receiving the status code such as "errors/%d.html". Statuses without a page fall
+// back to a page for their class and then to a generic page in the same directory, e.g.
+// "errors/4xx.html" and "errors/error.html", and finally to the built-in HTML body.
+// Files are read once and cached.
+func NewEmbeddedHTMLFormatter(fsys fs.FS, pattern string) *EmbeddedHTMLFormatter {
+	return &EmbeddedHTMLFormatter{
+		fsys:    fsys,
+		pattern: pattern,
+	}
+}
+
+// Format implements the Formatter interface
+func (f *EmbeddedHTMLFormatter) Format(w http.ResponseWriter, r *http.Request, err HTTPError) {
+	page := f.page(err.StatusCode())
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(err.StatusCode())
+	if page != nil {
+		w.Write(page)
+		return
+	}
+	writeHTMLBody(w, r, err)
+}
+
+// page returns the cached page for a status code, reading it on first use
+func (f *EmbeddedHTMLFormatter) page(code int) []byte {
+	if cached, ok := f.cache.Load(code); ok {
+		return cached.([]byte)
+	}
+	var page []byte
+	for _, name := range f.candidates(code) {
+		if b, err := fs.ReadFile(f.fsys, name); err == nil {
+			page = b
+			break
+		}
+	}
+	f.cache.Store(code, page)
+	return page
+}
+
+// candidates returns the file names tried for a status code, most specific first
+func (f *EmbeddedHTMLFormatter) candidates(code int) []string {
+	name := fmt.Sprintf(f.pattern, code)
+	dir, ext := path.Dir(name), path.Ext(name)
+	return []string{
+		name,
+		path.Join(dir, fmt.Sprintf("%dxx%s", code/100, ext)),
+		path.Join(dir, "error"+ext),
+	}
+}
@@ -2,8 +2,12 @@ package httperror
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
+	"sync/atomic"
+	"text/template"
 )
 
 // HTTPError represents an HTTP error with status code and message
@@ -14,6 +18,10 @@ type HTTPError interface {
 	Headers() map[string]string
 }
 
+// ErrResponseWritten can be returned by a handler that has already written its own
+// response. The handler stops processing without formatting or writing anything else.
+var ErrResponseWritten = errors.New("httperror: response already written")
+
 // HandlerFunc is a function that returns an HTTPError instead of writing directly to ResponseWriter
 type HandlerFunc func(w http.ResponseWriter, r *http.Request) error
 
@@ -25,16 +33,39 @@ type Formatter interface {
 	Format(w http.ResponseWriter, r *http.Request, err HTTPError)
 }
 
+// FormatterWithCause is an optional interface for formatters that need the original,
+// unsanitized error returned by the handler in addition to the HTTPError
+type FormatterWithCause interface {
+	FormatWithCause(w http.ResponseWriter, r *http.Request, err HTTPError, cause error)
+}
+
 // basicError is a basic implementation of HTTPError
 type basicError struct {
-	code    int
-	message string
-	headers map[string]string
-	cause   error
+	code            int
+	message         string
+	headers         map[string]string
+	headerTemplates map[string]*template.Template
+	errCode         string
+	category        string
+	fields          map[string]any
+	internalFields  map[string]any
+	fieldErrors     []FieldError
+	details         []any
+	cause           error
+}
+
+// errorOmitsCause is set with SetErrorIncludesCause(false)
+var errorOmitsCause atomic.Bool
+
+// SetErrorIncludesCause controls whether Error() on errors created by this package appends
+// the wrapped cause, as in "message: cause". It does by default; disabling it keeps internal
+// details out of logs that print errors. errors.Unwrap still returns the cause.
+func SetErrorIncludesCause(include bool) {
+	errorOmitsCause.Store(!include)
 }
 
 func (e *basicError) Error() string {
-	if e.cause != nil {
+	if e.cause != nil && !errorOmitsCause.Load() {
 		return fmt.Sprintf("%s: %v", e.message, e.cause)
 	}
 	return e.message
@@ -49,67 +80,268 @@ func (e *basicError) Message() string {
 }
 
 func (e *basicError) Headers() map[string]string {
+	if len(e.headerTemplates) > 0 {
+		return e.renderHeaders()
+	}
 	if e.headers == nil {
 		return make(map[string]string)
 	}
 	return e.headers
 }
 
+// renderHeaders returns the static headers merged with the executed header templates
+func (e *basicError) renderHeaders() map[string]string {
+	headers := make(map[string]string, len(e.headers)+len(e.headerTemplates))
+	for k, v := range e.headers {
+		headers[k] = v
+	}
+	data := headerTemplateData{
+		Status:     e.code,
+		StatusText: statusText(e.code),
+		Message:    e.message,
+		Code:       e.errCode,
+	}
+	for k, tmpl := range e.headerTemplates {
+		var b strings.Builder
+		if err := tmpl.Execute(&b, data); err != nil || !validRetryAfter(k, b.String()) {
+			continue
+		}
+		headers[k] = b.String()
+	}
+	return headers
+}
+
+// clone returns a copy of the error that can be modified without affecting the original
+func (e *basicError) clone() *basicError {
+	c := &basicError{
+		code:     e.code,
+		message:  e.message,
+		headers:  make(map[string]string, len(e.headers)),
+		errCode:  e.errCode,
+		category: e.category,
+		cause:    e.cause,
+	}
+	for k, v := range e.headers {
+		c.headers[k] = v
+	}
+	if len(e.fieldErrors) > 0 {
+		c.fieldErrors = append([]FieldError(nil), e.fieldErrors...)
+	}
+	if len(e.details) > 0 {
+		c.details = append([]any(nil), e.details...)
+	}
+	if len(e.fields) > 0 {
+		c.fields = make(map[string]any, len(e.fields))
+		for k, v := range e.fields {
+			c.fields[k] = v
+		}
+	}
+	if len(e.internalFields) > 0 {
+		c.internalFields = make(map[string]any, len(e.internalFields))
+		for k, v := range e.internalFields {
+			c.internalFields[k] = v
+		}
+	}
+	if len(e.headerTemplates) > 0 {
+		c.headerTemplates = make(map[string]*template.Template, len(e.headerTemplates))
+		for k, v := range e.headerTemplates {
+			c.headerTemplates[k] = v
+		}
+	}
+	return c
+}
+
+func (e *basicError) Code() string {
+	return e.errCode
+}
+
+func (e *basicError) Category() string {
+	return e.category
+}
+
+func (e *basicError) Fields() map[string]any {
+	return e.fields
+}
+
+func (e *basicError) InternalFields() map[string]any {
+	return e.internalFields
+}
+
+func (e *basicError) FieldErrors() []FieldError {
+	return e.fieldErrors
+}
+
+func (e *basicError) Details() []any {
+	return e.details
+}
+
 func (e *basicError) Unwrap() error {
 	return e.cause
 }
 
-// New creates a new HTTPError with the given status code and message
+// New creates a new HTTPError with the given status code and message.
+// Codes outside 100-599 are logged and replaced with 500.
 func New(code int, message string) HTTPError {
 	return &basicError{
-		code:    code,
+		code:    checkStatus(code),
 		message: message,
 		headers: make(map[string]string),
 	}
 }
 
-// Wrap wraps an existing error with HTTP status code
+// Wrap wraps an existing error with HTTP status code.
+// Codes outside 100-599 are logged and replaced with 500.
 func Wrap(code int, message string, err error) HTTPError {
 	return &basicError{
-		code:    code,
+		code:    checkStatus(code),
 		message: message,
 		headers: make(map[string]string),
 		cause:   err,
 	}
 }
 
-// WithHeaders adds headers to an HTTPError
+// Decompose extracts the status code and message of an error, e.g. to send it
+// over a non-HTTP transport. A nil error returns (0, "").
+func Decompose(err HTTPError) (status int, message string) {
+	if err == nil {
+		return 0, ""
+	}
+	return err.StatusCode(), err.Message()
+}
+
+// Recompose rebuilds an HTTPError from the values returned by Decompose
+func Recompose(status int, message string) HTTPError {
+	return New(status, message)
+}
+
+// WithHeaders adds headers to an HTTPError. The original error is not modified, so calls
+// to WithHeaders and WithHeader can be chained: later values replace earlier ones for the
+// same header name, compared case-insensitively. A nil error is returned as nil.
 func WithHeaders(err HTTPError, headers map[string]string) HTTPError {
+	if err == nil {
+		return nil
+	}
+
+	var c *basicError
 	if be, ok := err.(*basicError); ok {
-		newHeaders := make(map[string]string)
-		for k, v := range be.headers {
-			newHeaders[k] = v
-		}
-		for k, v := range headers {
-			newHeaders[k] = v
+		c = be.clone()
+	} else {
+		// For other implementations, create a new error
+		c = &basicError{
+			code:           err.StatusCode(),
+			message:        err.Message(),
+			headers:        make(map[string]string),
+			errCode:        CodeOf(err),
+			category:       CategoryOf(err),
+			fields:         FieldsOf(err),
+			internalFields: InternalFieldsOf(err),
+			fieldErrors:    FieldErrorsOf(err),
+			details:        DetailsOf(err),
+			cause:          err,
 		}
-		return &basicError{
-			code:    be.code,
-			message: be.message,
-			headers: newHeaders,
-			cause:   be.cause,
+		for k, v := range HeadersOf(err) {
+			c.headers[k] = v
 		}
 	}
 
-	// For other implementations, create a new error
-	newHeaders := make(map[string]string)
 	for k, v := range headers {
-		newHeaders[k] = v
+		c.setHeader(k, v)
+		c.deleteHeaderTemplate(k)
 	}
-	for k, v := range err.Headers() {
-		newHeaders[k] = v
+	return c
+}
+
+// deleteHeaderTemplate removes header templates for key, compared case-insensitively,
+// so a later static value replaces an earlier templated one
+func (e *basicError) deleteHeaderTemplate(key string) {
+	for k := range e.headerTemplates {
+		if strings.EqualFold(k, key) {
+			delete(e.headerTemplates, k)
+		}
 	}
+}
 
-	return &basicError{
-		code:    err.StatusCode(),
-		message: err.Message(),
-		headers: newHeaders,
+// setHeader sets a header, replacing any key that differs only in case. A Retry-After value
+// that is neither delay-seconds nor an HTTP-date is logged and dropped; a valid one on a
+// status it does not apply to is logged, and dropped in strict mode (see SetStrictHeaders).
+func (e *basicError) setHeader(key, value string) {
+	if !validRetryAfter(key, value) {
+		logger().Warn("httperror: dropping invalid Retry-After header", "value", value)
+		return
+	}
+	if strings.EqualFold(key, "Retry-After") && !retryAfterApplies(e.code) {
+		if strictHeaders.Load() {
+			return
+		}
+		logger().Warn("httperror: Retry-After attached to a non-retryable status", "status", e.code)
+	}
+	for k := range e.headers {
+		if k != key && strings.EqualFold(k, key) {
+			delete(e.headers, k)
+		}
+	}
+	e.headers[key] = value
+}
+
+// toBasic returns a modifiable basicError copy of err
+func toBasic(err HTTPError) *basicError {
+	if be, ok := err.(*basicError); ok {
+		return be.clone()
+	}
+	return WithHeaders(err, nil).(*basicError)
+}
+
+// HeadersOf returns the error's headers, always as a non-nil map
+func HeadersOf(err HTTPError) map[string]string {
+	if err == nil {
+		return make(map[string]string)
+	}
+	headers := err.Headers()
+	if headers == nil {
+		return make(map[string]string)
+	}
+	return headers
+}
+
+// WithHeader adds a single header to an HTTPError. A nil error is returned as nil.
+func WithHeader(err HTTPError, key, value string) HTTPError {
+	return WithHeaders(err, map[string]string{key: value})
+}
+
+// headerTemplateData is the data available to templates passed to WithTemplatedHeader
+type headerTemplateData struct {
+	Status     int
+	StatusText string
+	Message    string
+	Code       string
+}
+
+// WithTemplatedHeader adds a header whose value is rendered from a text/template when the
+// error is formatted. The template can reference .Status, .StatusText, .Message and .Code
+// (the machine code set with WithCode), as in the HTML and template set formatters.
+// If the template fails to parse, its text is used as a literal header value.
+// A nil error is returned as nil.
+func WithTemplatedHeader(err HTTPError, key, tmpl string) HTTPError {
+	if err == nil {
+		return nil
+	}
+	c := toBasic(err)
+	c.deleteHeaderTemplate(key)
+	t, parseErr := template.New(key).Parse(tmpl)
+	if parseErr != nil {
+		c.setHeader(key, tmpl)
+		return c
+	}
+	for k := range c.headers {
+		if strings.EqualFold(k, key) {
+			delete(c.headers, k)
+		}
+	}
+	if c.headerTemplates == nil {
+		c.headerTemplates = make(map[string]*template.Template)
 	}
+	c.headerTemplates[key] = t
+	return c
 }
 
 // AsHTTPError converts a regular error to HTTPError, defaulting to 500 if not already an HTTPError
@@ -1,12 +1,24 @@
 package httperror
 
 import (
+	"bytes"
 	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
 	"testing"
+	"testing/fstest"
+	"text/template"
+	"time"
 )
 
 func TestHTTPErrorInterface(t *testing.T) {
@@ -36,7 +48,10 @@ func TestErrorTypes(t *testing.T) {
 		{"Forbidden", Forbidden("test"), 403},
 		{"NotFound", NotFound("test"), 404},
 		{"MethodNotAllowed", MethodNotAllowed("test"), 405},
+		{"NotAcceptable", NotAcceptable("test"), 406},
+		{"RequestTimeout", RequestTimeout("test"), 408},
 		{"Conflict", Conflict("test"), 409},
+		{"MisdirectedRequest", MisdirectedRequest("test"), 421},
 		{"UnprocessableEntity", UnprocessableEntity("test"), 422},
 		{"InternalServerError", InternalServerError("test"), 500},
 		{"NotImplemented", NotImplemented("test"), 501},
@@ -191,3 +206,3322 @@ func TestWrapError(t *testing.T) {
 		t.Error("Expected basicError type")
 	}
 }
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		class     string
+		code      int
+		retryable bool
+	}{
+		{"NotFound", NotFound("missing"), ClassClientError, 404, false},
+		{"BadRequest", BadRequest("bad"), ClassClientError, 400, false},
+		{"TooManyRequests", New(http.StatusTooManyRequests, "slow down"), ClassClientError, 429, true},
+		{"InternalServerError", InternalServerError(""), ClassServerError, 500, false},
+		{"ServiceUnavailable", ServiceUnavailable(""), ClassServerError, 503, true},
+		{"PlainError", errors.New("boom"), ClassServerError, 500, false},
+		{"Nil", nil, "", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			class, code, retryable := Classify(tt.err)
+			if class != tt.class || code != tt.code || retryable != tt.retryable {
+				t.Errorf("Expected (%q, %d, %v), got (%q, %d, %v)",
+					tt.class, tt.code, tt.retryable, class, code, retryable)
+			}
+		})
+	}
+}
+
+func TestErrResponseWritten(t *testing.T) {
+	streamingHandler := func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("partial"))
+		return fmt.Errorf("stream aborted: %w", ErrResponseWritten)
+	}
+
+	req := httptest.NewRequest("GET", "/test", nil)
+	w := httptest.NewRecorder()
+
+	handler := NewHandler(streamingHandler)
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusAccepted {
+		t.Errorf("Expected status 202, got %d", w.Code)
+	}
+
+	if w.Body.String() != "partial" {
+		t.Errorf("Expected body to be left untouched, got '%s'", w.Body.String())
+	}
+}
+
+func TestWithTemplatedHeader(t *testing.T) {
+	err := WithTemplatedHeader(WithCode(Unauthorized("token expired"), "invalid_token"), "WWW-Authenticate",
+		`Bearer error="{{.Code}}", error_description="{{.Status}} {{.StatusText}}: {{.Message}}"`)
+
+	req := httptest.NewRequest("GET", "/test", nil)
+	w := httptest.NewRecorder()
+
+	handler := NewHandler(func(w http.ResponseWriter, r *http.Request) error {
+		return err
+	})
+	handler.ServeHTTP(w, req)
+
+	expected := `Bearer error="invalid_token", error_description="401 Unauthorized: token expired"`
+	if got := w.Header().Get("WWW-Authenticate"); got != expected {
+		t.Errorf("Expected header '%s', got '%s'", expected, got)
+	}
+}
+
+func TestHeaderLastWinsAcrossTemplates(t *testing.T) {
+	templated := WithTemplatedHeader(NotFound("missing"), "X-Foo", "{{.Status}}")
+
+	static := WithHeader(templated, "x-foo", "v")
+	if got := static.Headers(); len(got) != 1 || got["x-foo"] != "v" {
+		t.Errorf("Expected later static value to win, got %v", got)
+	}
+	if got := templated.Headers()["X-Foo"]; got != "404" {
+		t.Errorf("Expected original templated value to be unchanged, got '%s'", got)
+	}
+
+	retemplated := WithTemplatedHeader(static, "X-Foo", "{{.Message}}")
+	if got := retemplated.Headers(); len(got) != 1 || got["X-Foo"] != "missing" {
+		t.Errorf("Expected later templated value to win, got %v", got)
+	}
+}
+
+func TestErrorBuffer(t *testing.T) {
+	handler := NewHandler(func(w http.ResponseWriter, r *http.Request) error {
+		return NotFound(r.URL.Path + " not found")
+	}, WithErrorBuffer(2))
+
+	for _, path := range []string{"/a", "/b", "/c"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	entries := handler.ErrorBuffer().Entries()
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 entries, got %d", len(entries))
+	}
+
+	if entries[0].Path != "/b" || entries[1].Path != "/c" {
+		t.Errorf("Expected the two most recent paths, got '%s' and '%s'", entries[0].Path, entries[1].Path)
+	}
+
+	if entries[1].Status != http.StatusNotFound || entries[1].Message != "/c not found" {
+		t.Errorf("Unexpected entry: %+v", entries[1])
+	}
+}
+
+func TestBodyWriter(t *testing.T) {
+	RegisterBodyWriter("application/x-test", func(w io.Writer, r *http.Request, err HTTPError) error {
+		_, werr := fmt.Fprintf(w, "status=%d message=%s", err.StatusCode(), err.Message())
+		return werr
+	})
+
+	handler := NewHandlerWithFormatter(func(w http.ResponseWriter, r *http.Request) error {
+		return Conflict("already exists")
+	}, NewBodyWriterFormatter("application/x-test"))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/test", nil))
+
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected status 409, got %d", w.Code)
+	}
+
+	if ct := w.Header().Get("Content-Type"); ct != "application/x-test" {
+		t.Errorf("Expected content type 'application/x-test', got '%s'", ct)
+	}
+
+	if body := w.Body.String(); body != "status=409 message=already exists" {
+		t.Errorf("Unexpected body '%s'", body)
+	}
+}
+
+func TestBuiltinBodyWriters(t *testing.T) {
+	err := NotFound("<missing>")
+
+	for _, contentType := range []string{"text/plain", "application/json", "text/html"} {
+		t.Run(contentType, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			NewBodyWriterFormatter(contentType).Format(w, httptest.NewRequest("GET", "/", nil), err)
+
+			if w.Header().Get("Content-Type") != contentType {
+				t.Errorf("Expected content type '%s', got '%s'", contentType, w.Header().Get("Content-Type"))
+			}
+			if w.Code != http.StatusNotFound {
+				t.Errorf("Expected status 404, got %d", w.Code)
+			}
+			if w.Body.Len() == 0 {
+				t.Error("Expected a non-empty body")
+			}
+		})
+	}
+}
+
+func TestContextHandlerDeadlineExceeded(t *testing.T) {
+	contextHandler := func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		<-ctx.Done()
+		return errors.New("query canceled")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest("GET", "/test", nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+
+	handler := NewContextHandler(contextHandler)
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("Expected status 504, got %d", w.Code)
+	}
+}
+
+func TestFieldsAsHeaders(t *testing.T) {
+	err := WithCode(NotFound("user not found"), "user_not_found")
+	err = WithField(err, "field", "user\r\nSet-Cookie: x=y")
+
+	handler := NewHandlerWithFormatter(func(w http.ResponseWriter, r *http.Request) error {
+		return err
+	}, FieldsAsHeaders(&PlainTextFormatter{}, "X-Error-"))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/users/1", nil))
+
+	if got := w.Header().Get("X-Error-Code"); got != "user_not_found" {
+		t.Errorf("Expected X-Error-Code 'user_not_found', got '%s'", got)
+	}
+
+	if got := w.Header().Get("X-Error-Field"); got != "userSet-Cookie: x=y" {
+		t.Errorf("Expected sanitized X-Error-Field, got '%q'", got)
+	}
+
+	if w.Code != http.StatusNotFound || w.Body.String() != "user not found" {
+		t.Errorf("Expected base formatter output, got %d '%s'", w.Code, w.Body.String())
+	}
+}
+
+func TestFromError(t *testing.T) {
+	errMissing := errors.New("missing record")
+	errLocked := errors.New("record locked")
+	RegisterError(errMissing, http.StatusNotFound)
+	RegisterError(errLocked, http.StatusConflict)
+
+	tests := []struct {
+		name     string
+		err      error
+		expected int
+		message  string
+	}{
+		{"MappedSentinel", errMissing, 404, "Not Found"},
+		{"WrappedSentinel", fmt.Errorf("loading user: %w", errLocked), 409, "Conflict"},
+		{"WrappedHTTPError", fmt.Errorf("context: %w", Forbidden("nope")), 403, "nope"},
+		{"Unmapped", errors.New("disk on fire"), 500, "Internal Server Error"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			httpErr := FromError(tt.err)
+			if httpErr.StatusCode() != tt.expected {
+				t.Errorf("Expected status code %d, got %d", tt.expected, httpErr.StatusCode())
+			}
+			if httpErr.Message() != tt.message {
+				t.Errorf("Expected message '%s', got '%s'", tt.message, httpErr.Message())
+			}
+			if !errors.Is(httpErr, tt.err) && tt.name != "WrappedHTTPError" {
+				t.Error("Expected original error to remain in the chain")
+			}
+		})
+	}
+
+	if FromError(nil) != nil {
+		t.Error("Expected nil for nil error")
+	}
+}
+
+func TestJSONFormatterExtensions(t *testing.T) {
+	err := WithFields(UnprocessableEntity("invalid order"), map[string]any{"order_id": "42"})
+
+	tests := []struct {
+		name      string
+		formatter *JSONFormatter
+		nested    bool
+	}{
+		{"TopLevel", NewJSONFormatter(), false},
+		{"Nested", &JSONFormatter{NestExtensions: true}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			tt.formatter.Format(w, httptest.NewRequest("POST", "/orders", nil), err)
+
+			var body map[string]any
+			if decodeErr := json.Unmarshal(w.Body.Bytes(), &body); decodeErr != nil {
+				t.Fatalf("Failed to decode body: %v", decodeErr)
+			}
+
+			if body["error"] != "invalid order" {
+				t.Errorf("Expected error message in body, got %v", body["error"])
+			}
+
+			ext, hasExt := body["extensions"].(map[string]any)
+			if tt.nested {
+				if !hasExt || ext["order_id"] != "42" {
+					t.Errorf("Expected order_id under extensions, got %v", body)
+				}
+				if _, ok := body["order_id"]; ok {
+					t.Error("Expected order_id not to be at the top level")
+				}
+			} else if hasExt || body["order_id"] != "42" {
+				t.Errorf("Expected order_id at the top level, got %v", body)
+			}
+		})
+	}
+}
+
+func TestWithHelpersNil(t *testing.T) {
+	tests := []struct {
+		name string
+		fn   func() HTTPError
+	}{
+		{"WithHeaders", func() HTTPError { return WithHeaders(nil, map[string]string{"X-A": "b"}) }},
+		{"WithHeader", func() HTTPError { return WithHeader(nil, "X-A", "b") }},
+		{"WithTemplatedHeader", func() HTTPError { return WithTemplatedHeader(nil, "X-A", "{{.Status}}") }},
+		{"WithCode", func() HTTPError { return WithCode(nil, "code") }},
+		{"WithField", func() HTTPError { return WithField(nil, "key", "value") }},
+		{"WithFields", func() HTTPError { return WithFields(nil, map[string]any{"key": "value"}) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.fn(); err != nil {
+				t.Errorf("Expected nil, got %v", err)
+			}
+		})
+	}
+}
+
+func TestPlainTextFormatterTruncation(t *testing.T) {
+	err := InternalServerError(strings.Repeat("x", 100))
+
+	w := httptest.NewRecorder()
+	formatter := &PlainTextFormatter{MaxBodySize: 40}
+	formatter.Format(w, httptest.NewRequest("GET", "/", nil), err)
+
+	body := w.Body.String()
+	if len(body) != 40 {
+		t.Errorf("Expected body of 40 bytes, got %d", len(body))
+	}
+	if !strings.HasSuffix(body, "(truncated)") {
+		t.Errorf("Expected truncation notice, got '%s'", body)
+	}
+
+	w = httptest.NewRecorder()
+	(&PlainTextFormatter{}).Format(w, httptest.NewRequest("GET", "/", nil), err)
+	if w.Body.String() != err.Message() {
+		t.Error("Expected short message to be written unchanged")
+	}
+}
+
+// nilHeadersError is an HTTPError implementation returning nil headers
+type nilHeadersError struct{}
+
+func (nilHeadersError) Error() string              { return "teapot" }
+func (nilHeadersError) StatusCode() int            { return http.StatusTeapot }
+func (nilHeadersError) Message() string            { return "teapot" }
+func (nilHeadersError) Headers() map[string]string { return nil }
+
+func TestHeadersOf(t *testing.T) {
+	headers := HeadersOf(nilHeadersError{})
+	if headers == nil {
+		t.Fatal("Expected a non-nil map")
+	}
+	headers["X-Safe"] = "yes"
+
+	if HeadersOf(nil) == nil {
+		t.Error("Expected a non-nil map for a nil error")
+	}
+
+	withHeader := WithHeader(nilHeadersError{}, "X-A", "b")
+	if HeadersOf(withHeader)["X-A"] != "b" {
+		t.Error("Expected header to be added to custom error")
+	}
+}
+
+func TestBearerChallenges(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      HTTPError
+		status   int
+		expected string
+	}{
+		{
+			"UnauthorizedBearer",
+			UnauthorizedBearer("invalid_token", `The "access" token expired`),
+			401,
+			`Bearer error="invalid_token", error_description="The \"access\" token expired"`,
+		},
+		{
+			"UnauthorizedBearerNoError",
+			UnauthorizedBearer("", ""),
+			401,
+			`Bearer`,
+		},
+		{
+			"ForbiddenBearer",
+			ForbiddenBearer("read:users write:users"),
+			403,
+			`Bearer error="insufficient_scope", scope="read:users write:users"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.err.StatusCode() != tt.status {
+				t.Errorf("Expected status code %d, got %d", tt.status, tt.err.StatusCode())
+			}
+			if got := tt.err.Headers()["WWW-Authenticate"]; got != tt.expected {
+				t.Errorf("Expected challenge '%s', got '%s'", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestDecomposeRecompose(t *testing.T) {
+	for _, original := range []HTTPError{
+		NotFound("user not found"),
+		Wrap(502, "upstream failed", errors.New("dial tcp: refused")),
+		New(418, ""),
+	} {
+		status, message := Decompose(original)
+		roundTripped := Recompose(status, message)
+
+		if roundTripped.StatusCode() != original.StatusCode() {
+			t.Errorf("Expected status code %d, got %d", original.StatusCode(), roundTripped.StatusCode())
+		}
+		if roundTripped.Message() != original.Message() {
+			t.Errorf("Expected message '%s', got '%s'", original.Message(), roundTripped.Message())
+		}
+	}
+}
+
+func TestCodedPlainTextFormatter(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      HTTPError
+		expected string
+	}{
+		{"WithCode", WithCode(NotFound("User not found"), "user_not_found"), "[user_not_found] User not found"},
+		{"WithoutCode", NotFound("User not found"), "User not found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			(&CodedPlainTextFormatter{}).Format(w, httptest.NewRequest("GET", "/", nil), tt.err)
+			if w.Body.String() != tt.expected {
+				t.Errorf("Expected '%s', got '%s'", tt.expected, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestDebugFormatterRequestHeaders(t *testing.T) {
+	req := httptest.NewRequest("GET", "/users/1", nil)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", "Bearer secret")
+
+	formatter := &DebugFormatter{RequestHeaders: []string{"accept", "Authorization"}}
+	w := httptest.NewRecorder()
+	formatter.Format(w, req, NotFound("user not found"))
+
+	var body struct {
+		Error          string            `json:"error"`
+		Path           string            `json:"path"`
+		RequestHeaders map[string]string `json:"request_headers"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Failed to decode body: %v", err)
+	}
+
+	if body.RequestHeaders["Accept"] != "application/json" {
+		t.Errorf("Expected Accept to be echoed, got %v", body.RequestHeaders)
+	}
+	if _, ok := body.RequestHeaders["Authorization"]; ok {
+		t.Error("Expected Authorization not to be echoed")
+	}
+	if strings.Contains(w.Body.String(), "secret") {
+		t.Error("Expected credentials not to appear in the body")
+	}
+	if body.Path != "/users/1" || body.Error != "user not found" {
+		t.Errorf("Unexpected body: %+v", body)
+	}
+}
+
+func TestInternalWithSupport(t *testing.T) {
+	err := InternalWithSupport("https://example.com/support")
+
+	for name, formatter := range map[string]Formatter{
+		"PlainText": &PlainTextFormatter{},
+		"JSON":      NewJSONFormatter(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			formatter.Format(w, httptest.NewRequest("GET", "/", nil), err)
+
+			if w.Code != http.StatusInternalServerError {
+				t.Errorf("Expected status 500, got %d", w.Code)
+			}
+			if !strings.Contains(w.Body.String(), "https://example.com/support") {
+				t.Errorf("Expected support URL in body, got '%s'", w.Body.String())
+			}
+		})
+	}
+}
+
+// causeLoggingFormatter records the cause passed to FormatWithCause
+type causeLoggingFormatter struct {
+	PlainTextFormatter
+	logged []string
+}
+
+func (f *causeLoggingFormatter) FormatWithCause(w http.ResponseWriter, r *http.Request, err HTTPError, cause error) {
+	f.logged = append(f.logged, cause.Error())
+	f.Format(w, r, err)
+}
+
+func TestFormatterWithCause(t *testing.T) {
+	formatter := &causeLoggingFormatter{}
+	handler := NewHandlerWithFormatter(func(w http.ResponseWriter, r *http.Request) error {
+		return errors.New("connection refused")
+	}, formatter)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	if len(formatter.logged) != 1 || formatter.logged[0] != "connection refused" {
+		t.Errorf("Expected the original error to be passed, got %v", formatter.logged)
+	}
+	if w.Code != http.StatusInternalServerError || strings.Contains(w.Body.String(), "refused") {
+		t.Errorf("Expected sanitized 500 response, got %d '%s'", w.Code, w.Body.String())
+	}
+}
+
+func TestRequireAccept(t *testing.T) {
+	handler := NewHandler(RequireAccept("application/json")(func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}))
+
+	tests := []struct {
+		name     string
+		accept   string
+		expected int
+	}{
+		{"Exact", "application/json", 200},
+		{"WithParams", "text/html;q=0.9, application/json;q=0.8", 200},
+		{"Wildcard", "*/*", 200},
+		{"SubtypeWildcard", "application/*", 200},
+		{"Missing", "", 200},
+		{"Rejected", "text/html", 406},
+		{"ZeroWeight", "application/json;q=0", 406},
+		{"ExcludedFromWildcard", "application/json;q=0, */*;q=0.5", 406},
+		{"ExcludedFromSubtypeWildcard", "application/*;q=0, */*", 406},
+		{"SpecificOverridesExclusion", "application/*;q=0, application/json", 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tt.expected {
+				t.Errorf("Expected status %d, got %d", tt.expected, w.Code)
+			}
+		})
+	}
+}
+
+func TestPanicToError(t *testing.T) {
+	tests := []struct {
+		name      string
+		recovered any
+		status    int
+		message   string
+	}{
+		{"HTTPError", Forbidden("no access"), 403, "no access"},
+		{"Error", errors.New("nil map write"), 500, "Internal Server Error"},
+		{"String", "something broke", 500, "Internal Server Error"},
+		{"Other", 42, 500, "Internal Server Error"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := PanicToError(tt.recovered)
+			if err.StatusCode() != tt.status {
+				t.Errorf("Expected status code %d, got %d", tt.status, err.StatusCode())
+			}
+			if err.Message() != tt.message {
+				t.Errorf("Expected message '%s', got '%s'", tt.message, err.Message())
+			}
+			if tt.status == 500 && !strings.Contains(err.Error(), fmt.Sprint(tt.recovered)) {
+				t.Errorf("Expected panic value in error string, got '%s'", err.Error())
+			}
+		})
+	}
+
+	if PanicToError(nil) != nil {
+		t.Error("Expected nil for a nil recovered value")
+	}
+}
+
+func TestHandlerRecoversPanic(t *testing.T) {
+	handler := NewHandler(func(w http.ResponseWriter, r *http.Request) error {
+		panic("secret internal detail")
+	})
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status 500, got %d", w.Code)
+	}
+	if strings.Contains(w.Body.String(), "secret") {
+		t.Errorf("Expected panic value not to leak, got '%s'", w.Body.String())
+	}
+}
+
+func TestWithContentDisposition(t *testing.T) {
+	tests := []struct {
+		filename string
+		expected string
+	}{
+		{"report.txt", `attachment; filename="report.txt"`},
+		{`my "report".txt`, `attachment; filename="my \"report\".txt"`},
+		{"rapport-é.txt", `attachment; filename="rapport-_.txt"; filename*=UTF-8''rapport-%C3%A9.txt`},
+	}
+
+	for _, tt := range tests {
+		err := WithContentDisposition(InternalServerError("report"), tt.filename)
+		if got := err.Headers()["Content-Disposition"]; got != tt.expected {
+			t.Errorf("Expected '%s', got '%s'", tt.expected, got)
+		}
+	}
+}
+
+func TestBuilder(t *testing.T) {
+	cause := errors.New("no rows")
+	built := NewBuilder(404).
+		Message("User not found").
+		Header("X-A", "b").
+		Code("user_not_found").
+		Field("id", 7).
+		Cause(cause).
+		Build()
+
+	expected := WithField(WithCode(WithHeader(Wrap(404, "User not found", cause), "X-A", "b"), "user_not_found"), "id", 7)
+
+	if built.StatusCode() != expected.StatusCode() || built.Message() != expected.Message() {
+		t.Errorf("Expected %d '%s', got %d '%s'", expected.StatusCode(), expected.Message(), built.StatusCode(), built.Message())
+	}
+	if built.Headers()["X-A"] != "b" {
+		t.Errorf("Expected header X-A, got %v", built.Headers())
+	}
+	if CodeOf(built) != CodeOf(expected) || FieldsOf(built)["id"] != FieldsOf(expected)["id"] {
+		t.Errorf("Expected code and fields to match, got '%s' %v", CodeOf(built), FieldsOf(built))
+	}
+	if built.Error() != expected.Error() || !errors.Is(built, cause) {
+		t.Errorf("Expected cause to be wrapped, got '%s'", built.Error())
+	}
+
+	if NewBuilder(503).Build().Message() != "Service Unavailable" {
+		t.Error("Expected message to default to the status text")
+	}
+
+	headers := NewBuilder(503).Header("x-a", "1").Header("X-A", "2").Build().Headers()
+	if len(headers) != 1 || headers["X-A"] != "2" {
+		t.Errorf("Expected the last X-A to replace the first, got %v", headers)
+	}
+
+	SetLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	defer SetLogger(nil)
+	if _, ok := NewBuilder(503).Header("Retry-After", "soon").Build().Headers()["Retry-After"]; ok {
+		t.Error("Expected an invalid Retry-After to be dropped")
+	}
+}
+
+func TestBrowserAwareFormatter(t *testing.T) {
+	formatter := BrowserAwareFormatter(NewBodyWriterFormatter("text/html"), NewJSONFormatter())
+
+	browser := httptest.NewRequest("GET", "/users/1", nil)
+	browser.Header.Set("Accept", "text/html,application/xhtml+xml,*/*;q=0.8")
+	browser.Header.Set("Sec-Fetch-Mode", "navigate")
+	browser.Header.Set("Sec-Fetch-Dest", "document")
+
+	api := httptest.NewRequest("GET", "/users/1", nil)
+	api.Header.Set("Accept", "*/*")
+
+	tests := []struct {
+		name        string
+		req         *http.Request
+		contentType string
+	}{
+		{"Browser", browser, "text/html"},
+		{"APIClient", api, "application/json"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			formatter.Format(w, tt.req, NotFound("user not found"))
+
+			if ct := w.Header().Get("Content-Type"); ct != tt.contentType {
+				t.Errorf("Expected content type '%s', got '%s'", tt.contentType, ct)
+			}
+			if w.Header().Get("Vary") == "" {
+				t.Error("Expected a Vary header")
+			}
+		})
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	var seen string
+	handler := NewHandler(RequestID(RequestIDOptions{
+		Generator: func() string { return "generated-id" },
+	})(func(w http.ResponseWriter, r *http.Request) error {
+		seen = RequestIDFromContext(r.Context())
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", w.Code)
+	}
+	if got := w.Header().Get("X-Request-Id"); got != "generated-id" {
+		t.Errorf("Expected X-Request-Id 'generated-id' on success, got '%s'", got)
+	}
+	if seen != "generated-id" {
+		t.Errorf("Expected ID in context, got '%s'", seen)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Request-Id", "abc123")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if got := w.Header().Get("X-Request-Id"); got != "abc123" {
+		t.Errorf("Expected incoming ID to be propagated, got '%s'", got)
+	}
+}
+
+func TestMethodRouter(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+	router := NewMethodRouter().Handle("GET", ok).Handle("post", ok)
+	handler := NewHandler(router.Serve)
+
+	tests := []struct {
+		method string
+		status int
+		allow  string
+	}{
+		{"GET", 200, ""},
+		{"HEAD", 200, ""},
+		{"POST", 200, ""},
+		{"DELETE", 405, "GET, HEAD, OPTIONS, POST"},
+		{"OPTIONS", 204, "GET, HEAD, OPTIONS, POST"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(tt.method, "/items", nil))
+
+			if w.Code != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, w.Code)
+			}
+			if got := w.Header().Get("Allow"); got != tt.allow {
+				t.Errorf("Expected Allow '%s', got '%s'", tt.allow, got)
+			}
+		})
+	}
+}
+
+func TestLogJSON(t *testing.T) {
+	req := httptest.NewRequest("DELETE", "/users/7", nil)
+	err := WithCode(Wrap(409, "User has open orders", errors.New("fk violation")), "user_has_orders")
+
+	line := LogJSON(req, err)
+	if bytes.ContainsRune(line, '\n') {
+		t.Error("Expected a single-line record")
+	}
+
+	var rec map[string]any
+	if decodeErr := json.Unmarshal(line, &rec); decodeErr != nil {
+		t.Fatalf("Failed to decode record: %v", decodeErr)
+	}
+
+	expected := map[string]any{
+		"level":   "warn",
+		"status":  float64(409),
+		"method":  "DELETE",
+		"path":    "/users/7",
+		"message": "User has open orders",
+		"code":    "user_has_orders",
+		"cause":   "fk violation",
+	}
+	for k, v := range expected {
+		if rec[k] != v {
+			t.Errorf("Expected %s=%v, got %v", k, v, rec[k])
+		}
+	}
+	if _, parseErr := time.Parse(time.RFC3339Nano, rec["time"].(string)); parseErr != nil {
+		t.Errorf("Expected RFC 3339 time, got %v", rec["time"])
+	}
+
+	var plain map[string]any
+	json.Unmarshal(LogJSON(req, errors.New("boom")), &plain)
+	if plain["level"] != "error" || plain["status"] != float64(500) || plain["cause"] != "boom" {
+		t.Errorf("Unexpected record for plain error: %v", plain)
+	}
+}
+
+func TestExternalURL(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://internal:8080/orders/1?x=1", nil)
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-Host", "api.example.com, proxy.local")
+
+	tests := []struct {
+		name       string
+		req        *http.Request
+		trustProxy bool
+		expected   string
+	}{
+		{"Trusted", req, true, "https://api.example.com/orders/1?x=1"},
+		{"Untrusted", req, false, "http://internal:8080/orders/1?x=1"},
+		{"NoForwardedHeaders", httptest.NewRequest("GET", "http://internal:8080/orders/1", nil), true, "http://internal:8080/orders/1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ExternalURL(tt.req, tt.trustProxy).String(); got != tt.expected {
+				t.Errorf("Expected '%s', got '%s'", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestValidationErrorCap(t *testing.T) {
+	var fieldErrors []FieldError
+	for i := 0; i < 5; i++ {
+		fieldErrors = append(fieldErrors, FieldError{Field: fmt.Sprintf("field%d", i), Message: "required"})
+	}
+	err := ValidationError("", fieldErrors...)
+
+	if err.StatusCode() != http.StatusBadRequest || err.Message() != "Validation failed" {
+		t.Errorf("Unexpected error: %d '%s'", err.StatusCode(), err.Message())
+	}
+
+	w := httptest.NewRecorder()
+	(&JSONFormatter{MaxErrors: 3}).Format(w, httptest.NewRequest("POST", "/", nil), err)
+
+	var body struct {
+		Errors    []FieldError `json:"errors"`
+		Truncated bool         `json:"truncated"`
+	}
+	if decodeErr := json.Unmarshal(w.Body.Bytes(), &body); decodeErr != nil {
+		t.Fatalf("Failed to decode body: %v", decodeErr)
+	}
+
+	if len(body.Errors) != 3 || !body.Truncated {
+		t.Errorf("Expected 3 errors and truncated=true, got %d and %v", len(body.Errors), body.Truncated)
+	}
+	if body.Errors[0].Field != "field0" {
+		t.Errorf("Expected the first field errors to be kept, got %v", body.Errors)
+	}
+
+	w = httptest.NewRecorder()
+	NewJSONFormatter().Format(w, httptest.NewRequest("POST", "/", nil), err)
+	if strings.Contains(w.Body.String(), "truncated") {
+		t.Error("Expected no truncation below the default cap")
+	}
+}
+
+// sqlStateErr is a stub driver error exposing a SQLSTATE code
+type sqlStateErr string
+
+func (e sqlStateErr) Error() string    { return "driver error " + string(e) }
+func (e sqlStateErr) SQLState() string { return string(e) }
+
+func TestFromSQLError(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected int
+	}{
+		{"NoRows", fmt.Errorf("get user: %w", sql.ErrNoRows), 404},
+		{"UniqueViolation", fmt.Errorf("insert user: %w", sqlStateErr("23505")), 409},
+		{"NotNullViolation", sqlStateErr("23502"), 400},
+		{"UnknownState", sqlStateErr("XX000"), 500},
+		{"Other", errors.New("connection reset"), 500},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			httpErr := FromSQLError(tt.err)
+			if httpErr.StatusCode() != tt.expected {
+				t.Errorf("Expected status code %d, got %d", tt.expected, httpErr.StatusCode())
+			}
+			if !errors.Is(httpErr, tt.err) {
+				t.Error("Expected original error to remain in the chain")
+			}
+		})
+	}
+}
+
+func panickingHandler(w http.ResponseWriter, r *http.Request) error {
+	var m map[string]int
+	m["boom"]++
+	return nil
+}
+
+func TestOnPanicTrimsStack(t *testing.T) {
+	var logged []byte
+	var recovered any
+	handler := NewHandler(panickingHandler, OnPanic(func(r *http.Request, v any, stack []byte) {
+		recovered, logged = v, stack
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status 500, got %d", w.Code)
+	}
+	if recovered == nil {
+		t.Fatal("Expected OnPanic to be called")
+	}
+	first, _, _ := strings.Cut(string(logged), "\n")
+	if first != "github.com/perbu/httperror.panickingHandler" {
+		t.Errorf("Expected stack to start at the handler, got '%s'", first)
+	}
+}
+
+func TestCompactJSONFormatter(t *testing.T) {
+	tests := []struct {
+		name      string
+		formatter *CompactJSONFormatter
+		expected  string
+	}{
+		{"Default", NewCompactJSONFormatter(), `{"e":"not found"}`},
+		{"CustomKey", &CompactJSONFormatter{Key: "err"}, `{"err":"not found"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			tt.formatter.Format(w, httptest.NewRequest("GET", "/", nil), NotFound("not found"))
+
+			if w.Body.String() != tt.expected {
+				t.Errorf("Expected '%s', got '%s'", tt.expected, w.Body.String())
+			}
+			if w.Code != http.StatusNotFound {
+				t.Errorf("Expected status 404, got %d", w.Code)
+			}
+		})
+	}
+}
+
+func TestOn5xx(t *testing.T) {
+	var fired []int
+	hook := On5xx(func(r *http.Request, err HTTPError) {
+		fired = append(fired, err.StatusCode())
+	})
+
+	handlers := []*Handler{
+		NewHandler(func(w http.ResponseWriter, r *http.Request) error { return NotFound("") }, hook),
+		NewHandler(func(w http.ResponseWriter, r *http.Request) error { return errors.New("db down") }, hook),
+		NewHandler(func(w http.ResponseWriter, r *http.Request) error { panic("boom") }, hook),
+	}
+	for _, handler := range handlers {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+
+	if len(fired) != 2 || fired[0] != 500 || fired[1] != 500 {
+		t.Errorf("Expected hook to fire for the error and the panic only, got %v", fired)
+	}
+}
+
+func TestDeadlineAware(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2500*time.Millisecond)
+	defer cancel()
+
+	err := DeadlineAware(ctx, ServiceUnavailable(""))
+	if got := err.Headers()["Retry-After"]; got != "3" {
+		t.Errorf("Expected Retry-After '3', got '%s'", got)
+	}
+
+	noDeadline := DeadlineAware(context.Background(), ServiceUnavailable(""))
+	if _, ok := noDeadline.Headers()["Retry-After"]; ok {
+		t.Error("Expected no Retry-After without a deadline")
+	}
+
+	expired, cancelExpired := context.WithDeadline(context.Background(), time.Now().Add(-time.Minute))
+	defer cancelExpired()
+	if got := DeadlineAware(expired, GatewayTimeout("")).Headers()["Retry-After"]; got != "1" {
+		t.Errorf("Expected minimum Retry-After '1', got '%s'", got)
+	}
+}
+
+// setClock fixes nowFunc for the duration of a test
+func setClock(t *testing.T, now time.Time) {
+	t.Helper()
+	previous := nowFunc
+	nowFunc = func() time.Time { return now }
+	t.Cleanup(func() { nowFunc = previous })
+}
+
+func TestFixedClock(t *testing.T) {
+	setClock(t, time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC))
+
+	var rec map[string]any
+	json.Unmarshal(LogJSON(httptest.NewRequest("GET", "/", nil), NotFound("")), &rec)
+	if rec["time"] != "2024-05-01T12:30:00Z" {
+		t.Errorf("Expected deterministic timestamp, got %v", rec["time"])
+	}
+
+	buffer := NewErrorBuffer(1)
+	buffer.Record(nil, NotFound(""))
+	if !buffer.Entries()[0].Time.Equal(nowFunc()) {
+		t.Errorf("Expected buffer entry at the fixed time, got %v", buffer.Entries()[0].Time)
+	}
+}
+
+func TestErrorMappings(t *testing.T) {
+	errQuota := errors.New("quota exceeded")
+	RegisterError(errQuota, http.StatusTooManyRequests)
+
+	mappings := ErrorMappings()
+	if mappings[errQuota] != http.StatusTooManyRequests {
+		t.Errorf("Expected mapping to 429, got %d", mappings[errQuota])
+	}
+
+	mappings[errQuota] = http.StatusTeapot
+	if ErrorMappings()[errQuota] != http.StatusTooManyRequests {
+		t.Error("Expected ErrorMappings to return a copy")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected RegisterError to panic for a non-comparable target")
+		}
+		if _, ok := ErrorMappings()[errQuota]; !ok {
+			t.Error("Expected existing mappings to survive the rejected registration")
+		}
+	}()
+	RegisterError(uncomparableError{codes: []int{1}}, http.StatusBadRequest)
+}
+
+type uncomparableError struct{ codes []int }
+
+func (uncomparableError) Error() string { return "uncomparable" }
+
+func TestCommonLogFormat(t *testing.T) {
+	setClock(t, time.Date(2000, 10, 10, 13, 55, 36, 0, time.FixedZone("", -7*3600)))
+
+	req := httptest.NewRequest("GET", "/apache_pb.gif?x=1", nil)
+	req.RemoteAddr = "127.0.0.1:54321"
+	req.SetBasicAuth("frank", "secret")
+
+	expected := `127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif?x=1 HTTP/1.1" 404 2326`
+	if got := CommonLogFormat(req, 404, 2326); got != expected {
+		t.Errorf("Expected '%s', got '%s'", expected, got)
+	}
+
+	anonymous := httptest.NewRequest("POST", "/", nil)
+	anonymous.RemoteAddr = "10.0.0.1:1"
+	if got := CommonLogFormat(anonymous, 500, 0); !strings.HasPrefix(got, "10.0.0.1 - - [") || !strings.HasSuffix(got, `"POST / HTTP/1.1" 500 -`) {
+		t.Errorf("Unexpected line for anonymous request: '%s'", got)
+	}
+}
+
+func TestHandlerHeadersPreserved(t *testing.T) {
+	handler := NewHandler(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("Cache-Control", "max-age=60")
+		return WithHeader(New(http.StatusTooManyRequests, "slow down"), "Cache-Control", "no-store")
+	})
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	if got := w.Header().Get("X-RateLimit-Remaining"); got != "0" {
+		t.Errorf("Expected handler header to survive, got '%s'", got)
+	}
+	if got := w.Header().Values("Cache-Control"); len(got) != 1 || got[0] != "no-store" {
+		t.Errorf("Expected error header to override the handler's, got %v", got)
+	}
+}
+
+func TestRequestIDPlainTextFormatter(t *testing.T) {
+	errorHandler := func(w http.ResponseWriter, r *http.Request) error {
+		return NotFound("User not found")
+	}
+	formatter := &RequestIDPlainTextFormatter{}
+
+	withID := NewHandlerWithFormatter(RequestID(RequestIDOptions{
+		Generator: func() string { return "abc123" },
+	})(errorHandler), formatter)
+	w := httptest.NewRecorder()
+	withID.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	if expected := "User not found (request id: abc123)"; w.Body.String() != expected {
+		t.Errorf("Expected '%s', got '%s'", expected, w.Body.String())
+	}
+
+	withoutID := NewHandlerWithFormatter(errorHandler, formatter)
+	w = httptest.NewRecorder()
+	withoutID.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	if w.Body.String() != "User not found" {
+		t.Errorf("Expected bare message, got '%s'", w.Body.String())
+	}
+}
+
+func TestRequestIDCustomHeaderReachesFormatters(t *testing.T) {
+	middleware := RequestID(RequestIDOptions{Header: "X-Correlation-Id"})
+	errorHandler := middleware(func(w http.ResponseWriter, r *http.Request) error {
+		return NotFound("User not found")
+	})
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Correlation-Id", "corr-42")
+	w := httptest.NewRecorder()
+	NewHandlerWithFormatter(errorHandler, &RequestIDPlainTextFormatter{}).ServeHTTP(w, r)
+	if expected := "User not found (request id: corr-42)"; w.Body.String() != expected {
+		t.Errorf("Expected '%s', got '%s'", expected, w.Body.String())
+	}
+
+	set := NewTemplateFormatterSet(map[string]Template{
+		"text/plain": template.Must(template.New("t").Parse("{{.Message}} [{{.RequestID}}]")),
+	}, "text/plain")
+	w = httptest.NewRecorder()
+	NewHandlerWithFormatter(errorHandler, set).ServeHTTP(w, r)
+	if expected := "User not found [corr-42]"; w.Body.String() != expected {
+		t.Errorf("Expected '%s', got '%s'", expected, w.Body.String())
+	}
+}
+
+func TestHTMLTemplateFormatter(t *testing.T) {
+	tmpl := htmltemplate.Must(htmltemplate.New("error").Parse(
+		`<h1>{{.Status}}</h1><p>{{.Message}}</p><small>{{.RequestID}}</small>`))
+
+	formatter := NewHTMLTemplateFormatter(tmpl, func(r *http.Request, err HTTPError) any {
+		return struct {
+			Status    int
+			Message   string
+			RequestID string
+		}{err.StatusCode(), err.Message(), r.Header.Get("X-Request-Id")}
+	})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Request-Id", "req-42")
+	w := httptest.NewRecorder()
+	formatter.Format(w, req, NotFound("<gone>"))
+
+	expected := `<h1>404</h1><p>&lt;gone&gt;</p><small>req-42</small>`
+	if w.Body.String() != expected {
+		t.Errorf("Expected '%s', got '%s'", expected, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	NewHTMLTemplateFormatter(htmltemplate.Must(htmltemplate.New("").Parse(`{{.StatusText}}`)), nil).Format(w, req, NotFound(""))
+	if w.Body.String() != "Not Found" {
+		t.Errorf("Expected default template data, got '%s'", w.Body.String())
+	}
+}
+
+func TestWithRetryAfterStatusCheck(t *testing.T) {
+	var logs bytes.Buffer
+	SetLogger(slog.New(slog.NewTextHandler(&logs, nil)))
+	defer SetLogger(nil)
+
+	if got := WithRetryAfter(ServiceUnavailable(""), 30*time.Second).Headers()["Retry-After"]; got != "30" || logs.Len() != 0 {
+		t.Errorf("Expected Retry-After '30' without warning, got '%s' and log '%s'", got, logs.String())
+	}
+
+	if got := WithRetryAfter(NotFound(""), time.Minute).Headers()["Retry-After"]; got != "60" {
+		t.Errorf("Expected header to be kept in lenient mode, got '%s'", got)
+	}
+	if !strings.Contains(logs.String(), "status=404") {
+		t.Errorf("Expected a warning for 404, got '%s'", logs.String())
+	}
+
+	logs.Reset()
+	if got := WithHeader(NotFound(""), "Retry-After", "10").Headers()["Retry-After"]; got != "10" {
+		t.Errorf("Expected WithHeader to keep the header in lenient mode, got '%s'", got)
+	}
+	if !strings.Contains(logs.String(), "status=404") {
+		t.Errorf("Expected a warning for WithHeader on 404, got '%s'", logs.String())
+	}
+
+	SetStrictHeaders(true)
+	defer SetStrictHeaders(false)
+	if _, ok := WithRetryAfter(NotFound(""), time.Minute).Headers()["Retry-After"]; ok {
+		t.Error("Expected header to be dropped in strict mode")
+	}
+	if _, ok := WithHeader(NotFound(""), "Retry-After", "10").Headers()["Retry-After"]; ok {
+		t.Error("Expected WithHeader to drop the header in strict mode")
+	}
+	if _, ok := WithHeaders(NotFound(""), map[string]string{"retry-after": "10"}).Headers()["retry-after"]; ok {
+		t.Error("Expected WithHeaders to drop the header in strict mode")
+	}
+	if got := WithHeader(ServiceUnavailable(""), "Retry-After", "10").Headers()["Retry-After"]; got != "10" {
+		t.Errorf("Expected Retry-After on 503 to be kept in strict mode, got '%s'", got)
+	}
+}
+
+func TestWithSanitizeServerErrors(t *testing.T) {
+	failing := func(w http.ResponseWriter, r *http.Request) error {
+		return errors.New("replica lag 12s on db-3")
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/public", NewHandler(failing))
+	mux.Handle("/internal", NewHandler(failing, WithSanitizeServerErrors(false)))
+
+	tests := []struct {
+		path    string
+		exposed bool
+	}{
+		{"/public", false},
+		{"/internal", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+
+			if w.Code != http.StatusInternalServerError {
+				t.Errorf("Expected status 500, got %d", w.Code)
+			}
+			if exposed := strings.Contains(w.Body.String(), "replica lag"); exposed != tt.exposed {
+				t.Errorf("Expected detail exposed=%v, got body '%s'", tt.exposed, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestStatusTextCache(t *testing.T) {
+	for code := 0; code < 700; code++ {
+		if statusText(code) != http.StatusText(code) {
+			t.Errorf("Expected '%s' for %d, got '%s'", http.StatusText(code), code, statusText(code))
+		}
+	}
+}
+
+func BenchmarkStatusText(b *testing.B) {
+	codes := []int{400, 404, 409, 422, 500, 503}
+
+	b.Run("http.StatusText", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_ = http.StatusText(codes[i%len(codes)])
+		}
+	})
+
+	b.Run("cached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_ = statusText(codes[i%len(codes)])
+		}
+	})
+}
+
+func BenchmarkJSONFormatter(b *testing.B) {
+	formatter := NewJSONFormatter()
+	req := httptest.NewRequest("GET", "/", nil)
+	err := NotFound("user not found")
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		formatter.Format(httptest.NewRecorder(), req, err)
+	}
+}
+
+func TestPathInt(t *testing.T) {
+	var gotID int
+	mux := http.NewServeMux()
+	mux.Handle("/users/{id}", NewHandler(func(w http.ResponseWriter, r *http.Request) error {
+		id, err := PathInt(r, "id")
+		if err != nil {
+			return err
+		}
+		gotID = id
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}))
+	mux.Handle("/other", NewHandler(func(w http.ResponseWriter, r *http.Request) error {
+		_, err := PathInt(r, "id")
+		return err
+	}))
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+		body   string
+	}{
+		{"Valid", "/users/42", 200, ""},
+		{"NonNumeric", "/users/abc", 400, `Path parameter "id" must be an integer`},
+		{"Missing", "/other", 400, `Missing path parameter "id"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+
+			if w.Code != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, w.Code)
+			}
+			if w.Body.String() != tt.body {
+				t.Errorf("Expected body '%s', got '%s'", tt.body, w.Body.String())
+			}
+		})
+	}
+
+	if gotID != 42 {
+		t.Errorf("Expected id 42, got %d", gotID)
+	}
+}
+
+func TestJSONFormatterKeyedErrors(t *testing.T) {
+	err := ValidationError("",
+		FieldError{Field: "name", Message: "required"},
+		FieldError{Field: "age", Message: "must be a number"},
+		FieldError{Field: "age", Message: "must be positive"},
+	)
+
+	w := httptest.NewRecorder()
+	(&JSONFormatter{KeyedErrors: true}).Format(w, httptest.NewRequest("POST", "/users", nil), err)
+
+	var body struct {
+		Errors map[string]string `json:"errors"`
+	}
+	if decodeErr := json.Unmarshal(w.Body.Bytes(), &body); decodeErr != nil {
+		t.Fatalf("Failed to decode keyed errors: %v", decodeErr)
+	}
+
+	expected := map[string]string{
+		"name": "required",
+		"age":  "must be a number; must be positive",
+	}
+	if len(body.Errors) != len(expected) {
+		t.Fatalf("Expected %d fields, got %v", len(expected), body.Errors)
+	}
+	for field, message := range expected {
+		if body.Errors[field] != message {
+			t.Errorf("Expected %s='%s', got '%s'", field, message, body.Errors[field])
+		}
+	}
+}
+
+func TestWithCleanup(t *testing.T) {
+	var logs bytes.Buffer
+	SetLogger(slog.New(slog.NewTextHandler(&logs, nil)))
+	defer SetLogger(nil)
+
+	cleanupErr := errors.New("close failed")
+	tests := []struct {
+		name       string
+		handlerErr error
+		status     int
+	}{
+		{"HandlerSucceeded", nil, 500},
+		{"HandlerFailed", NotFound("missing"), 404},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs.Reset()
+			cleaned := false
+			handler := NewHandler(WithCleanup(func(w http.ResponseWriter, r *http.Request) error {
+				return tt.handlerErr
+			}, func() error {
+				cleaned = true
+				return cleanupErr
+			}))
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+			if !cleaned {
+				t.Error("Expected cleanup to run")
+			}
+			if w.Code != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, w.Code)
+			}
+			if !strings.Contains(logs.String(), "close failed") {
+				t.Errorf("Expected cleanup error to be logged, got '%s'", logs.String())
+			}
+		})
+	}
+}
+
+func TestDeprecated(t *testing.T) {
+	sunset := time.Date(2025, 12, 31, 23, 59, 59, 0, time.UTC)
+	handler := NewHandler(Deprecated(sunset)(func(w http.ResponseWriter, r *http.Request) error {
+		return BadRequest("invalid")
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/v1/users", nil))
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", w.Code)
+	}
+	if got := w.Header().Get("Deprecation"); got != "true" {
+		t.Errorf("Expected Deprecation 'true', got '%s'", got)
+	}
+	if got := w.Header().Get("Sunset"); got != "Wed, 31 Dec 2025 23:59:59 GMT" {
+		t.Errorf("Expected Sunset as HTTP-date, got '%s'", got)
+	}
+}
+
+func TestBuiltinFormattersSetContentType(t *testing.T) {
+	formatters := map[string]Formatter{
+		"PlainText":          &PlainTextFormatter{},
+		"CodedPlainText":     &CodedPlainTextFormatter{},
+		"RequestIDPlainText": &RequestIDPlainTextFormatter{},
+		"JSON":               NewJSONFormatter(),
+		"CompactJSON":        NewCompactJSONFormatter(),
+		"Debug":              NewDebugFormatter(),
+		"HTMLTemplate":       NewHTMLTemplateFormatter(htmltemplate.Must(htmltemplate.New("").Parse("{{.Message}}")), nil),
+		"BrowserAware":       BrowserAwareFormatter(NewBodyWriterFormatter("text/html"), NewJSONFormatter()),
+		"FieldsAsHeaders":    FieldsAsHeaders(NewJSONFormatter(), "X-Error-"),
+		"Named":              NamedFormatter("json", NewJSONFormatter()),
+		"GoogleJSON":         NewGoogleJSONFormatter(),
+		"ColorText":          NewColorTextFormatter(),
+		"ColorText CLI": FormatterFunc(func(w http.ResponseWriter, r *http.Request, err HTTPError) {
+			r = r.Clone(r.Context())
+			r.Header.Set("X-Client", "cli")
+			NewColorTextFormatter().Format(w, r, err)
+		}),
+		"Negotiating":          NewNegotiatingFormatter(nil).Register("application/json", NewJSONFormatter()),
+		"Negotiating fallback": NewNegotiatingFormatter(&PlainTextFormatter{}),
+		"EmbeddedHTML": NewEmbeddedHTMLFormatter(fstest.MapFS{
+			"errors/404.html": {Data: []byte("<h1>Not here</h1>")},
+		}, "errors/%d.html"),
+		"EmbeddedHTML missing page": NewEmbeddedHTMLFormatter(fstest.MapFS{}, "errors/%d.html"),
+		"TemplateSet": NewTemplateFormatterSet(map[string]Template{
+			"application/json": template.Must(template.New("").Parse(`{"error":{{printf "%q" .Message}}}`)),
+		}, "application/json"),
+		"HSTS":        WithHSTS(NewJSONFormatter(), time.Hour, false),
+		"Traceparent": WithTraceparent(NewJSONFormatter()),
+		"WireEncoded": WireEncoded(NewJSONFormatter()),
+	}
+	bodyWritersMu.RLock()
+	for contentType := range bodyWriters {
+		formatters["BodyWriter "+contentType] = NewBodyWriterFormatter(contentType)
+	}
+	bodyWritersMu.RUnlock()
+
+	for name, formatter := range formatters {
+		t.Run(name, func(t *testing.T) {
+			handler := NewHandlerWithFormatter(func(w http.ResponseWriter, r *http.Request) error {
+				return NotFound("missing")
+			}, formatter)
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+			if w.Header().Get("Content-Type") == "" {
+				t.Error("Expected a non-empty Content-Type")
+			}
+		})
+	}
+
+	t.Run("NilFormatter", func(t *testing.T) {
+		handler := NewHandlerWithFormatter(func(w http.ResponseWriter, r *http.Request) error {
+			return NotFound("missing")
+		}, nil)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+		if w.Header().Get("Content-Type") == "" {
+			t.Error("Expected a non-empty Content-Type")
+		}
+	})
+}
+
+func TestWithConnectionClose(t *testing.T) {
+	handler := NewHandler(func(w http.ResponseWriter, r *http.Request) error {
+		return WithConnectionClose(BadRequest("malformed request"))
+	})
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	if got := w.Header().Get("Connection"); got != "close" {
+		t.Errorf("Expected Connection 'close', got '%s'", got)
+	}
+}
+
+func TestRespond(t *testing.T) {
+	type user struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+	}
+
+	w := httptest.NewRecorder()
+	Respond(w, httptest.NewRequest("GET", "/users/1", nil), user{ID: 1, Name: "Alice"}, nil, NewJSONFormatter())
+
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("Expected 200 JSON response, got %d '%s'", w.Code, w.Header().Get("Content-Type"))
+	}
+	if body := strings.TrimSpace(w.Body.String()); body != `{"id":1,"name":"Alice"}` {
+		t.Errorf("Unexpected body '%s'", body)
+	}
+
+	w = httptest.NewRecorder()
+	Respond(w, httptest.NewRequest("GET", "/users/2", nil), user{}, NotFound("user not found"), NewJSONFormatter())
+
+	var body map[string]any
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if w.Code != http.StatusNotFound || body["error"] != "user not found" {
+		t.Errorf("Expected formatted 404, got %d '%s'", w.Code, w.Body.String())
+	}
+}
+
+func TestSetStatusText(t *testing.T) {
+	SetStatusText(http.StatusInternalServerError, "Whoops")
+	defer SetStatusText(http.StatusInternalServerError, "")
+
+	err := InternalServerError("")
+
+	w := httptest.NewRecorder()
+	NewJSONFormatter().Format(w, httptest.NewRequest("GET", "/", nil), err)
+	var body map[string]any
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if body["code"] != "Whoops" {
+		t.Errorf("Expected JSON code 'Whoops', got %v", body["code"])
+	}
+
+	w = httptest.NewRecorder()
+	NewBodyWriterFormatter("text/html").Format(w, httptest.NewRequest("GET", "/", nil), err)
+	if !strings.Contains(w.Body.String(), "<title>500 Whoops</title>") {
+		t.Errorf("Expected custom phrase in HTML title, got '%s'", w.Body.String())
+	}
+
+	SetStatusText(http.StatusInternalServerError, "")
+	if statusText(http.StatusInternalServerError) != "Internal Server Error" {
+		t.Error("Expected empty text to restore the default")
+	}
+}
+
+func TestNewLazy(t *testing.T) {
+	calls := 0
+	err := NewLazy(http.StatusBadRequest, func() string {
+		calls++
+		return "expensive message"
+	})
+
+	if err.StatusCode() != http.StatusBadRequest || calls != 0 {
+		t.Errorf("Expected message not to be computed yet, got %d calls", calls)
+	}
+
+	if err.Message() != "expensive message" || err.Error() != "expensive message" {
+		t.Errorf("Unexpected message '%s'", err.Message())
+	}
+	err.Message()
+	if calls != 1 {
+		t.Errorf("Expected message to be computed once, got %d calls", calls)
+	}
+}
+
+func TestNamedFormatter(t *testing.T) {
+	formatter := BrowserAwareFormatter(
+		NamedFormatter("html", NewBodyWriterFormatter("text/html")),
+		NamedFormatter("json", NewJSONFormatter()),
+	)
+
+	browser := httptest.NewRequest("GET", "/", nil)
+	browser.Header.Set("Accept", "text/html")
+	browser.Header.Set("Sec-Fetch-Mode", "navigate")
+
+	tests := []struct {
+		name     string
+		req      *http.Request
+		expected string
+	}{
+		{"Browser", browser, "html"},
+		{"APIClient", httptest.NewRequest("GET", "/", nil), "json"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			formatter.Format(w, tt.req, NotFound(""))
+
+			if got := w.Header().Get("X-Error-Formatter"); got != tt.expected {
+				t.Errorf("Expected X-Error-Formatter '%s', got '%s'", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestHeaderChaining(t *testing.T) {
+	for name, base := range map[string]HTTPError{
+		"BasicError":  BadRequest("bad"),
+		"CustomError": nilHeadersError{},
+	} {
+		t.Run(name, func(t *testing.T) {
+			first := WithHeaders(base, map[string]string{"X-A": "1", "X-B": "1"})
+			second := WithHeader(first, "x-b", "2")
+			third := WithHeaders(second, map[string]string{"X-A": "3", "X-C": "3"})
+
+			expected := map[string]string{"X-A": "3", "x-b": "2", "X-C": "3"}
+			got := third.Headers()
+			if len(got) != len(expected) {
+				t.Fatalf("Expected %v, got %v", expected, got)
+			}
+			for k, v := range expected {
+				if got[k] != v {
+					t.Errorf("Expected %s=%s, got %v", k, v, got)
+				}
+			}
+
+			if first.Headers()["X-A"] != "1" || first.Headers()["X-B"] != "1" {
+				t.Errorf("Expected earlier errors to be unchanged, got %v", first.Headers())
+			}
+		})
+	}
+}
+
+func TestUpstreamTimeout(t *testing.T) {
+	err := UpstreamTimeout("billing-service")
+
+	if err.StatusCode() != http.StatusGatewayTimeout {
+		t.Errorf("Expected status code 504, got %d", err.StatusCode())
+	}
+	if FieldsOf(err)["upstream"] != "billing-service" {
+		t.Errorf("Expected upstream field, got %v", FieldsOf(err))
+	}
+	if CodeOf(err) != "upstream_timeout" {
+		t.Errorf("Expected code 'upstream_timeout', got '%s'", CodeOf(err))
+	}
+
+	if CodeOf(RequestTimeout("")) == CodeOf(err) || RequestTimeout("").StatusCode() != http.StatusRequestTimeout {
+		t.Error("Expected request timeouts to be distinguishable from upstream timeouts")
+	}
+}
+
+func TestSetErrorIncludesCause(t *testing.T) {
+	cause := errors.New("password=hunter2 rejected")
+	err := Wrap(http.StatusBadGateway, "Upstream failed", cause)
+
+	if err.Error() != "Upstream failed: password=hunter2 rejected" {
+		t.Errorf("Expected cause to be included by default, got '%s'", err.Error())
+	}
+
+	SetErrorIncludesCause(false)
+	defer SetErrorIncludesCause(true)
+
+	if err.Error() != "Upstream failed" {
+		t.Errorf("Expected cause to be omitted, got '%s'", err.Error())
+	}
+	if !errors.Is(err, cause) {
+		t.Error("Expected cause to remain unwrappable")
+	}
+}
+
+func TestProblemErrors(t *testing.T) {
+	got := ProblemErrors(
+		FieldError{Field: "name", Message: "required"},
+		FieldError{Field: "a/b~c", Message: "invalid"},
+	)
+
+	expected := []ProblemFieldError{
+		{Detail: "required", Pointer: "/name"},
+		{Detail: "invalid", Pointer: "/a~1b~0c"},
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("Expected %d entries, got %d", len(expected), len(got))
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Errorf("Expected %+v, got %+v", expected[i], got[i])
+		}
+	}
+
+	b, _ := json.Marshal(got[0])
+	if string(b) != `{"detail":"required","pointer":"/name"}` {
+		t.Errorf("Unexpected JSON '%s'", b)
+	}
+}
+
+func TestDebugFormatterQuery(t *testing.T) {
+	req := httptest.NewRequest("GET", "/search?page=abc&token=s3cret", nil)
+
+	formatter := &DebugFormatter{QueryParams: []string{"page"}}
+	w := httptest.NewRecorder()
+	formatter.Format(w, req, BadRequest("invalid page"))
+
+	var body struct {
+		Query map[string]string `json:"query"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Failed to decode body: %v", err)
+	}
+
+	if body.Query["page"] != "abc" {
+		t.Errorf("Expected page to be echoed, got %v", body.Query)
+	}
+	if _, ok := body.Query["token"]; ok || strings.Contains(w.Body.String(), "s3cret") {
+		t.Errorf("Expected token to be omitted, got '%s'", w.Body.String())
+	}
+}
+
+func TestDecodeJSONStrict(t *testing.T) {
+	type address struct {
+		City string `json:"city"`
+	}
+	type user struct {
+		Name    string  `json:"name"`
+		Age     int     `json:"age"`
+		Address address `json:"address"`
+		Secret  string  `json:"-"`
+	}
+
+	body := `{"name":"Alice","Age":30,"nickname":"al","role":"admin","Secret":"x","address":{"city":"Oslo","zip":"0150"}}`
+	req := httptest.NewRequest("POST", "/users", strings.NewReader(body))
+
+	var u user
+	err := DecodeJSONStrict(req, &u)
+	if err == nil {
+		t.Fatal("Expected unknown fields to be rejected")
+	}
+	if err.StatusCode() != http.StatusBadRequest {
+		t.Errorf("Expected status code 400, got %d", err.StatusCode())
+	}
+
+	var fields []string
+	for _, fe := range FieldErrorsOf(err) {
+		fields = append(fields, fe.Field)
+	}
+	if strings.Join(fields, ",") != "Secret,address.zip,nickname,role" {
+		t.Errorf("Expected all unknown fields to be reported, got %v", fields)
+	}
+
+	req = httptest.NewRequest("POST", "/users", strings.NewReader(`{"name":"Bob","address":{"city":"Bergen"}}`))
+	if err := DecodeJSONStrict(req, &u); err != nil {
+		t.Errorf("Expected valid body to decode, got %v", err)
+	}
+	if u.Name != "Bob" || u.Address.City != "Bergen" {
+		t.Errorf("Unexpected decoded value %+v", u)
+	}
+
+	req = httptest.NewRequest("POST", "/users", strings.NewReader(`{"name":`))
+	if err := DecodeJSONStrict(req, &u); err == nil || len(FieldErrorsOf(err)) != 0 {
+		t.Errorf("Expected a plain 400 for malformed JSON, got %v", err)
+	}
+}
+
+func TestDecodeJSONStrictCollections(t *testing.T) {
+	type item struct {
+		Name string `json:"name"`
+	}
+	type order struct {
+		Items  []item          `json:"items"`
+		Pair   [1]*item        `json:"pair"`
+		ByName map[string]item `json:"by_name"`
+		Tags   []string        `json:"tags"`
+	}
+
+	body := `{"items":[{"name":"a"},{"name":"b","bogus":1}],"pair":[{"extra":true}],"by_name":{"x":{"size":2}},"tags":["t"]}`
+	var o order
+	err := DecodeJSONStrict(httptest.NewRequest("POST", "/orders", strings.NewReader(body)), &o)
+	if err == nil {
+		t.Fatal("Expected unknown fields in collections to be rejected")
+	}
+
+	var fields []string
+	for _, fe := range FieldErrorsOf(err) {
+		fields = append(fields, fe.Field)
+	}
+	if got := strings.Join(fields, ","); got != `by_name["x"].size,items[1].bogus,pair[0].extra` {
+		t.Errorf("Expected unknown fields inside collections, got %s", got)
+	}
+}
+
+func TestDecodeJSONStrictBodyLimit(t *testing.T) {
+	body := `{"name":"` + strings.Repeat("a", MaxStrictJSONBodySize) + `"}`
+	var v struct {
+		Name string `json:"name"`
+	}
+	err := DecodeJSONStrict(httptest.NewRequest("POST", "/", strings.NewReader(body)), &v)
+	if err == nil || err.StatusCode() != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for an oversized body, got %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/", strings.NewReader(`{"name":"too long"}`))
+	r.Body = http.MaxBytesReader(w, r.Body, 4)
+	if err := DecodeJSONStrict(r, &v); err == nil || err.StatusCode() != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 from http.MaxBytesReader, got %v", err)
+	}
+}
+
+func TestWithPreload(t *testing.T) {
+	err := WithPreload(NotFound(""), "/css/error.css", "style")
+	if got := err.Headers()["Link"]; got != "</css/error.css>; rel=preload; as=style" {
+		t.Errorf("Unexpected Link header '%s'", got)
+	}
+
+	err = WithPreload(err, "/fonts/brand.woff2", "font")
+	expected := "</css/error.css>; rel=preload; as=style, </fonts/brand.woff2>; rel=preload; as=font"
+	if got := err.Headers()["Link"]; got != expected {
+		t.Errorf("Expected '%s', got '%s'", expected, got)
+	}
+}
+
+func TestNegotiatingFormatter(t *testing.T) {
+	formatter := NewNegotiatingFormatter(nil).
+		Register("application/json", NewJSONFormatter()).
+		Register("text/html", NewBodyWriterFormatter("text/html"))
+
+	tests := []struct {
+		name        string
+		accept      string
+		status      int
+		contentType string
+	}{
+		{"JSON", "application/json", 404, "application/json"},
+		{"PreferHTML", "application/json;q=0.5, text/html", 404, "text/html"},
+		{"Wildcard", "*/*", 404, "application/json"},
+		{"NoAccept", "", 404, "application/json"},
+		{"Unsatisfiable", "application/xml", 406, "text/plain"},
+		{"ExcludedJSON", "application/json;q=0, */*;q=0.5", 404, "text/html"},
+		{"EqualWeightsInHeaderOrder", "text/html, application/json", 404, "text/html"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			w := httptest.NewRecorder()
+			formatter.Format(w, req, NotFound("missing"))
+
+			if w.Code != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, w.Code)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != tt.contentType {
+				t.Errorf("Expected content type '%s', got '%s'", tt.contentType, ct)
+			}
+			if w.Header().Get("Vary") != "Accept" {
+				t.Errorf("Expected Vary 'Accept', got '%s'", w.Header().Get("Vary"))
+			}
+			if tt.status == 406 && !strings.Contains(w.Body.String(), "application/json, text/html") {
+				t.Errorf("Expected available types in body, got '%s'", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestNestedNegotiationVariesOnce(t *testing.T) {
+	set := NewTemplateFormatterSet(map[string]Template{
+		"text/plain": template.Must(template.New("plain").Parse("{{.Message}}")),
+	}, "text/plain")
+	formatter := BrowserAwareFormatter(NewBodyWriterFormatter("text/html"),
+		NewNegotiatingFormatter(nil).Register("text/plain", set))
+
+	handler := NewHandlerWithFormatter(func(w http.ResponseWriter, r *http.Request) error {
+		return NotFound("missing")
+	}, formatter)
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept", "text/plain")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	vary := strings.Join(w.Header().Values("Vary"), ", ")
+	if strings.Count(vary, "Accept") != 1 {
+		t.Errorf("Expected Accept once in Vary, got '%s'", vary)
+	}
+	for _, name := range []string{"Sec-Fetch-Mode", "Sec-Fetch-Dest"} {
+		if !strings.Contains(vary, name) {
+			t.Errorf("Expected %s in Vary, got '%s'", name, vary)
+		}
+	}
+}
+
+func TestRetryTransient(t *testing.T) {
+	previous := retryBackoff
+	retryBackoff = func(int) time.Duration { return 0 }
+	defer func() { retryBackoff = previous }()
+
+	tests := []struct {
+		name     string
+		method   string
+		err      HTTPError
+		attempts int
+		status   int
+	}{
+		{"RetryableSucceeds", "GET", ServiceUnavailable(""), 3, 200},
+		{"NonRetryable", "GET", BadRequest(""), 1, 400},
+		{"NonIdempotent", "POST", ServiceUnavailable(""), 1, 503},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			handler := NewHandler(RetryTransient(func(w http.ResponseWriter, r *http.Request) error {
+				calls++
+				w.Header().Set("X-Attempt", strconv.Itoa(calls))
+				if calls < 3 {
+					return tt.err
+				}
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte("ok"))
+				return nil
+			}, 3))
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(tt.method, "/", nil))
+
+			if calls != tt.attempts {
+				t.Errorf("Expected %d attempts, got %d", tt.attempts, calls)
+			}
+			if w.Code != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, w.Code)
+			}
+			if got := w.Header().Values("X-Attempt"); len(got) != 1 || got[0] != strconv.Itoa(calls) {
+				t.Errorf("Expected only the final attempt's headers, got %v", got)
+			}
+		})
+	}
+}
+
+func TestRetryTransientLargeBody(t *testing.T) {
+	previous := retryBackoff
+	retryBackoff = func(int) time.Duration { return 0 }
+	defer func() { retryBackoff = previous }()
+
+	calls := 0
+	handler := NewHandler(RetryTransient(func(w http.ResponseWriter, r *http.Request) error {
+		calls++
+		return ServiceUnavailable("")
+	}, 3))
+
+	tests := []struct {
+		name          string
+		contentLength int64
+		attempts      int
+	}{
+		{"Small", 4, 3},
+		{"TooLarge", MaxRetryBodySize + 1, 1},
+		{"UnknownLength", -1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls = 0
+			r := httptest.NewRequest("PUT", "/", strings.NewReader("data"))
+			r.ContentLength = tt.contentLength
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+			if calls != tt.attempts {
+				t.Errorf("Expected %d attempts, got %d", tt.attempts, calls)
+			}
+		})
+	}
+}
+
+func TestPublicAndInternalFields(t *testing.T) {
+	err := WithPublicFields(NotFound("order not found"), map[string]any{"order_id": "42"})
+	err = WithInternalFields(err, map[string]any{"shard": "db-7", "tenant_id": 1001})
+
+	req := httptest.NewRequest("GET", "/orders/42", nil)
+	for name, formatter := range map[string]Formatter{
+		"JSON":  NewJSONFormatter(),
+		"Debug": NewDebugFormatter(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			formatter.Format(w, req, err)
+
+			if !strings.Contains(w.Body.String(), `"order_id"`) {
+				t.Errorf("Expected public field in body, got '%s'", w.Body.String())
+			}
+			if strings.Contains(w.Body.String(), "db-7") || strings.Contains(w.Body.String(), "tenant_id") {
+				t.Errorf("Expected internal fields not to be serialized, got '%s'", w.Body.String())
+			}
+		})
+	}
+
+	var rec struct {
+		Fields map[string]any `json:"fields"`
+	}
+	json.Unmarshal(LogJSON(req, err), &rec)
+	if rec.Fields["shard"] != "db-7" {
+		t.Errorf("Expected internal fields in the log record, got %v", rec.Fields)
+	}
+	if _, ok := rec.Fields["order_id"]; ok {
+		t.Error("Expected only internal fields in the log record")
+	}
+}
+
+func TestEmbeddedHTMLFormatter(t *testing.T) {
+	fsys := fstest.MapFS{
+		"errors/404.html": {Data: []byte("<h1>Page not found</h1>")},
+	}
+	formatter := NewEmbeddedHTMLFormatter(fsys, "errors/%d.html")
+
+	w := httptest.NewRecorder()
+	formatter.Format(w, httptest.NewRequest("GET", "/", nil), NotFound(""))
+	if w.Code != http.StatusNotFound || w.Body.String() != "<h1>Page not found</h1>" {
+		t.Errorf("Expected custom 404 page, got %d '%s'", w.Code, w.Body.String())
+	}
+
+	// The page is cached, so removing it from the file system has no effect
+	delete(fsys, "errors/404.html")
+	w = httptest.NewRecorder()
+	formatter.Format(w, httptest.NewRequest("GET", "/", nil), NotFound(""))
+	if w.Body.String() != "<h1>Page not found</h1>" {
+		t.Errorf("Expected cached page, got '%s'", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	formatter.Format(w, httptest.NewRequest("GET", "/", nil), InternalServerError(""))
+	if w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), "<title>500 Internal Server Error</title>") {
+		t.Errorf("Expected generic page for 500, got %d '%s'", w.Code, w.Body.String())
+	}
+}
+
+func TestEmbeddedHTMLFormatterFallbackPages(t *testing.T) {
+	formatter := NewEmbeddedHTMLFormatter(fstest.MapFS{
+		"errors/404.html":   {Data: []byte("not found page")},
+		"errors/4xx.html":   {Data: []byte("client error page")},
+		"errors/error.html": {Data: []byte("generic page")},
+	}, "errors/%d.html")
+
+	tests := []struct {
+		err  HTTPError
+		body string
+	}{
+		{NotFound(""), "not found page"},
+		{Conflict("taken"), "client error page"},
+		{ServiceUnavailable("down"), "generic page"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		formatter.Format(w, httptest.NewRequest("GET", "/", nil), tt.err)
+		if w.Code != tt.err.StatusCode() || w.Body.String() != tt.body {
+			t.Errorf("Expected %d '%s', got %d '%s'", tt.err.StatusCode(), tt.body, w.Code, w.Body.String())
+		}
+	}
+}
+
+// badStatusError is an HTTPError implementation with an arbitrary status code
+type badStatusError int
+
+func (e badStatusError) Error() string              { return "bad status" }
+func (e badStatusError) StatusCode() int            { return int(e) }
+func (e badStatusError) Message() string            { return "bad status" }
+func (e badStatusError) Headers() map[string]string { return nil }
+
+func TestInvalidStatusCodes(t *testing.T) {
+	var logs bytes.Buffer
+	SetLogger(slog.New(slog.NewTextHandler(&logs, nil)))
+	defer SetLogger(nil)
+
+	for _, code := range []int{0, 99, 600, 4040} {
+		t.Run(strconv.Itoa(code), func(t *testing.T) {
+			logs.Reset()
+			if got := New(code, "oops").StatusCode(); got != http.StatusInternalServerError {
+				t.Errorf("Expected New to use 500, got %d", got)
+			}
+			if !strings.Contains(logs.String(), "status="+strconv.Itoa(code)) {
+				t.Errorf("Expected invalid code to be logged, got '%s'", logs.String())
+			}
+
+			handler := NewHandler(func(w http.ResponseWriter, r *http.Request) error {
+				return badStatusError(code)
+			})
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+			if w.Code != http.StatusInternalServerError {
+				t.Errorf("Expected handler to write 500, got %d", w.Code)
+			}
+		})
+	}
+}
+
+func TestWithServerTiming(t *testing.T) {
+	handler := NewHandler(func(w http.ResponseWriter, r *http.Request) error {
+		time.Sleep(10 * time.Millisecond)
+		return ServiceUnavailable("busy")
+	}, WithServerTiming("app"))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	timing := w.Header().Get("Server-Timing")
+	dur, ok := strings.CutPrefix(timing, "app;dur=")
+	if !ok {
+		t.Fatalf("Expected Server-Timing 'app;dur=...', got '%s'", timing)
+	}
+	ms, err := strconv.ParseFloat(dur, 64)
+	if err != nil {
+		t.Fatalf("Expected numeric duration, got '%s'", dur)
+	}
+	if ms < 10 || ms > 5000 {
+		t.Errorf("Expected duration of at least 10ms, got %v", ms)
+	}
+
+	// Without the option no header is written
+	w = httptest.NewRecorder()
+	NewHandler(func(w http.ResponseWriter, r *http.Request) error {
+		return NotFound("missing")
+	}).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if got := w.Header().Get("Server-Timing"); got != "" {
+		t.Errorf("Expected no Server-Timing header, got '%s'", got)
+	}
+}
+
+func TestWithExpires(t *testing.T) {
+	expires := time.Date(2025, time.March, 4, 15, 30, 0, 0, time.FixedZone("CET", 3600))
+	err := WithExpires(NotFound("gone"), expires)
+
+	expected := "Tue, 04 Mar 2025 14:30:00 GMT"
+	if got := err.Headers()["Expires"]; got != expected {
+		t.Errorf("Expected Expires '%s', got '%s'", expected, got)
+	}
+	if WithExpires(nil, expires) != nil {
+		t.Error("Expected nil error to stay nil")
+	}
+}
+
+func TestRequireHTTPS(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	t.Run("redirect", func(t *testing.T) {
+		handler := NewHandler(RequireHTTPS(true, false)(ok))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/a?b=c", nil))
+		if w.Code != http.StatusMovedPermanently {
+			t.Errorf("Expected status 301, got %d", w.Code)
+		}
+		if got := w.Header().Get("Location"); got != "https://example.com/a?b=c" {
+			t.Errorf("Expected Location 'https://example.com/a?b=c', got '%s'", got)
+		}
+	})
+
+	t.Run("redirect keeps method", func(t *testing.T) {
+		handler := NewHandler(RequireHTTPS(true, false)(ok))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", "http://example.com/login", strings.NewReader("a=b")))
+		if w.Code != http.StatusPermanentRedirect {
+			t.Errorf("Expected status 308, got %d", w.Code)
+		}
+		if got := w.Header().Get("Location"); got != "https://example.com/login" {
+			t.Errorf("Expected Location 'https://example.com/login', got '%s'", got)
+		}
+	})
+
+	t.Run("redirect ignores forwarded host", func(t *testing.T) {
+		handler := NewHandler(RequireHTTPS(true, true)(ok))
+		r := httptest.NewRequest("GET", "http://example.com/login", nil)
+		r.Header.Set("X-Forwarded-Host", "evil.example")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if got := w.Header().Get("Location"); got != "https://example.com/login" {
+			t.Errorf("Expected Location 'https://example.com/login', got '%s'", got)
+		}
+	})
+
+	t.Run("forbidden", func(t *testing.T) {
+		handler := NewHandler(RequireHTTPS(false, false)(ok))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/", nil))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected status 403, got %d", w.Code)
+		}
+	})
+
+	t.Run("forwarded https untrusted", func(t *testing.T) {
+		handler := NewHandler(RequireHTTPS(false, false)(ok))
+		r := httptest.NewRequest("GET", "http://example.com/", nil)
+		r.Header.Set("X-Forwarded-Proto", "https")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected status 403, got %d", w.Code)
+		}
+	})
+
+	t.Run("forwarded https trusted", func(t *testing.T) {
+		handler := NewHandler(RequireHTTPS(false, true)(ok))
+		r := httptest.NewRequest("GET", "http://example.com/", nil)
+		r.Header.Set("X-Forwarded-Proto", "https")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusNoContent {
+			t.Errorf("Expected status 204, got %d", w.Code)
+		}
+	})
+}
+
+func TestGoogleJSONFormatter(t *testing.T) {
+	tests := []struct {
+		err    HTTPError
+		status string
+	}{
+		{NotFound("Book not found"), "NOT_FOUND"},
+		{BadRequest("bad"), "INVALID_ARGUMENT"},
+		{Unauthorized("who"), "UNAUTHENTICATED"},
+		{ServiceUnavailable("down"), "UNAVAILABLE"},
+		{New(http.StatusTeapot, "teapot"), "UNKNOWN"},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		NewGoogleJSONFormatter().Format(w, httptest.NewRequest("GET", "/", nil), tt.err)
+
+		var body struct {
+			Error struct {
+				Code    int    `json:"code"`
+				Message string `json:"message"`
+				Status  string `json:"status"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("Failed to decode body: %v", err)
+		}
+		if body.Error.Code != tt.err.StatusCode() {
+			t.Errorf("Expected code %d, got %d", tt.err.StatusCode(), body.Error.Code)
+		}
+		if body.Error.Message != tt.err.Message() {
+			t.Errorf("Expected message '%s', got '%s'", tt.err.Message(), body.Error.Message)
+		}
+		if body.Error.Status != tt.status {
+			t.Errorf("Expected status '%s', got '%s'", tt.status, body.Error.Status)
+		}
+	}
+}
+
+func TestWithHSTS(t *testing.T) {
+	formatter := WithHSTS(&PlainTextFormatter{}, 365*24*time.Hour, true)
+
+	w := httptest.NewRecorder()
+	formatter.Format(w, httptest.NewRequest("GET", "https://example.com/", nil), NotFound("missing"))
+	expected := "max-age=31536000; includeSubDomains"
+	if got := w.Header().Get("Strict-Transport-Security"); got != expected {
+		t.Errorf("Expected Strict-Transport-Security '%s', got '%s'", expected, got)
+	}
+	if w.Code != http.StatusNotFound || w.Body.String() != "missing" {
+		t.Errorf("Expected base formatter output, got %d '%s'", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	formatter.Format(w, httptest.NewRequest("GET", "http://example.com/", nil), NotFound("missing"))
+	if got := w.Header().Get("Strict-Transport-Security"); got != "" {
+		t.Errorf("Expected no Strict-Transport-Security on plaintext, got '%s'", got)
+	}
+
+	w = httptest.NewRecorder()
+	WithHSTS(nil, time.Hour, false).Format(w, httptest.NewRequest("GET", "https://example.com/", nil), NotFound("missing"))
+	if w.Body.String() != "missing" || w.Header().Get("Strict-Transport-Security") != "max-age=3600" {
+		t.Errorf("Expected a nil base to format plain text, got '%s' %v", w.Body.String(), w.Header())
+	}
+}
+
+func TestFromMultipartError(t *testing.T) {
+	t.Run("missing boundary", func(t *testing.T) {
+		r := httptest.NewRequest("POST", "/upload", strings.NewReader("data"))
+		r.Header.Set("Content-Type", "multipart/form-data")
+		err := FromMultipartError(r.ParseMultipartForm(1 << 20))
+		if err == nil || err.StatusCode() != http.StatusBadRequest {
+			t.Fatalf("Expected 400, got %v", err)
+		}
+		if !errors.Is(err, http.ErrMissingBoundary) {
+			t.Error("Expected cause to be http.ErrMissingBoundary")
+		}
+	})
+
+	t.Run("oversized part", func(t *testing.T) {
+		body := "--b\r\nContent-Disposition: form-data; name=\"comment\"\r\n\r\n" +
+			strings.Repeat("x", 11<<20) + "\r\n--b--\r\n"
+		r := httptest.NewRequest("POST", "/upload", strings.NewReader(body))
+		r.Header.Set("Content-Type", "multipart/form-data; boundary=b")
+		err := FromMultipartError(r.ParseMultipartForm(1024))
+		if err == nil || err.StatusCode() != http.StatusRequestEntityTooLarge {
+			t.Fatalf("Expected 413, got %v", err)
+		}
+	})
+
+	t.Run("body limit", func(t *testing.T) {
+		body := "--b\r\nContent-Disposition: form-data; name=\"f\"; filename=\"a.txt\"\r\n\r\n" +
+			strings.Repeat("x", 4096) + "\r\n--b--\r\n"
+		r := httptest.NewRequest("POST", "/upload", strings.NewReader(body))
+		r.Header.Set("Content-Type", "multipart/form-data; boundary=b")
+		r.Body = http.MaxBytesReader(httptest.NewRecorder(), r.Body, 1024)
+		err := FromMultipartError(r.ParseMultipartForm(1 << 20))
+		if err == nil || err.StatusCode() != http.StatusRequestEntityTooLarge {
+			t.Fatalf("Expected 413, got %v", err)
+		}
+	})
+
+	if FromMultipartError(nil) != nil {
+		t.Error("Expected nil error to stay nil")
+	}
+}
+
+func TestLogJSONRedactsSensitiveHeaders(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer secret-token")
+	req.Header.Set("X-Tenant", "acme")
+
+	line := LogJSON(req, NotFound("missing"))
+	if bytes.Contains(line, []byte("secret-token")) {
+		t.Fatalf("Expected Authorization to be redacted, got %s", line)
+	}
+	var rec struct {
+		Headers map[string]string `json:"headers"`
+	}
+	json.Unmarshal(line, &rec)
+	if rec.Headers["Authorization"] != RedactedValue {
+		t.Errorf("Expected Authorization '%s', got '%s'", RedactedValue, rec.Headers["Authorization"])
+	}
+	if rec.Headers["X-Tenant"] != "acme" {
+		t.Errorf("Expected X-Tenant 'acme', got '%s'", rec.Headers["X-Tenant"])
+	}
+
+	// The set is configurable
+	SetSensitiveHeaders("x-tenant")
+	defer SetSensitiveHeaders(DefaultSensitiveHeaders...)
+	json.Unmarshal(LogJSON(req, NotFound("missing")), &rec)
+	if rec.Headers["X-Tenant"] != RedactedValue {
+		t.Errorf("Expected X-Tenant to be redacted, got '%s'", rec.Headers["X-Tenant"])
+	}
+	if rec.Headers["Authorization"] != "Bearer secret-token" {
+		t.Errorf("Expected Authorization to be logged, got '%s'", rec.Headers["Authorization"])
+	}
+}
+
+func TestWithDetails(t *testing.T) {
+	type retryInfo struct {
+		Type       string `json:"@type"`
+		RetryDelay string `json:"retryDelay"`
+	}
+	base := ServiceUnavailable("Try later")
+	err := WithDetails(base, retryInfo{"type.googleapis.com/google.rpc.RetryInfo", "5s"})
+	err = WithDetails(err, map[string]any{"@type": "type.googleapis.com/google.rpc.ErrorInfo", "reason": "QUOTA"})
+
+	if len(DetailsOf(base)) != 0 {
+		t.Error("Expected original error to be unchanged")
+	}
+
+	w := httptest.NewRecorder()
+	NewJSONFormatter().Format(w, httptest.NewRequest("GET", "/", nil), err)
+
+	var body struct {
+		Details []map[string]any `json:"details"`
+	}
+	if decodeErr := json.Unmarshal(w.Body.Bytes(), &body); decodeErr != nil {
+		t.Fatalf("Failed to decode body: %v", decodeErr)
+	}
+	if len(body.Details) != 2 {
+		t.Fatalf("Expected 2 details, got %d", len(body.Details))
+	}
+	if body.Details[0]["@type"] != "type.googleapis.com/google.rpc.RetryInfo" || body.Details[0]["retryDelay"] != "5s" {
+		t.Errorf("Unexpected first detail: %v", body.Details[0])
+	}
+	if body.Details[1]["reason"] != "QUOTA" {
+		t.Errorf("Unexpected second detail: %v", body.Details[1])
+	}
+	if WithDetails(nil, "x") != nil {
+		t.Error("Expected nil error to stay nil")
+	}
+}
+
+func TestLogfmtLogger(t *testing.T) {
+	var buf bytes.Buffer
+	handler := NewHandler(func(w http.ResponseWriter, r *http.Request) error {
+		return WithCode(Wrap(404, `User "7" not found`, errors.New("no rows")), "user_not_found")
+	}, OnError(LogfmtLogger(&buf)))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/7", nil))
+
+	expected := `status=404 method=GET path=/users/7 route=/users/7 msg="User \"7\" not found" code=user_not_found cause="no rows"` + "\n"
+	if buf.String() != expected {
+		t.Errorf("Expected '%s', got '%s'", expected, buf.String())
+	}
+
+	if got := Logfmt(nil, BadRequest("")); got != `status=400 msg=""` {
+		t.Errorf("Expected empty message to be quoted, got '%s'", got)
+	}
+	err := WithInternalFields(NotFound("gone"), map[string]any{"shard": "db-7", "tenant id": 1001})
+	if got, expected := Logfmt(nil, err), `status=404 msg=gone field.shard=db-7 field.tenant_id=1001`; got != expected {
+		t.Errorf("Expected '%s', got '%s'", expected, got)
+	}
+}
+
+func TestConflictFields(t *testing.T) {
+	err := ConflictFields(
+		FieldError{Field: "email", Message: "already used by another account"},
+		FieldError{Field: "version", Message: "stale"},
+	)
+	if err.StatusCode() != http.StatusConflict {
+		t.Errorf("Expected status 409, got %d", err.StatusCode())
+	}
+
+	w := httptest.NewRecorder()
+	NewJSONFormatter().Format(w, httptest.NewRequest("PUT", "/users/1", nil), err)
+
+	var body struct {
+		Errors []FieldError `json:"errors"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if len(body.Errors) != 2 || body.Errors[0].Field != "email" || body.Errors[1].Field != "version" {
+		t.Errorf("Expected conflicting fields email and version, got %v", body.Errors)
+	}
+}
+
+func TestStats(t *testing.T) {
+	ResetStats()
+	defer ResetStats()
+
+	var status int
+	handler := NewHandler(func(w http.ResponseWriter, r *http.Request) error {
+		return New(status, "error")
+	})
+	for _, status = range []int{404, 404, 503, 404} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+
+	stats := Stats()
+	if stats[404] != 3 || stats[503] != 1 || len(stats) != 2 {
+		t.Errorf("Expected 3x404 and 1x503, got %v", stats)
+	}
+
+	ResetStats()
+	if stats := Stats(); len(stats) != 0 {
+		t.Errorf("Expected no counts after reset, got %v", stats)
+	}
+}
+
+func TestTemplateFormatterSet(t *testing.T) {
+	formatter := NewTemplateFormatterSet(map[string]Template{
+		"application/json": template.Must(template.New("json").Parse(
+			`{"status":{{.Status}},"message":{{printf "%q" .Message}},"code":{{printf "%q" .Code}},"request_id":{{printf "%q" .RequestID}}}`)),
+		"text/html": htmltemplate.Must(htmltemplate.New("html").Parse(
+			`<h1>{{.Status}} {{.StatusText}}</h1><p>{{.Message}}</p><small>{{.RequestID}}</small>`)),
+	}, "application/json")
+
+	err := WithCode(NotFound("No <user> 7"), "user_not_found")
+
+	tests := []struct {
+		accept      string
+		contentType string
+		body        string
+	}{
+		{"application/json", "application/json",
+			`{"status":404,"message":"No <user> 7","code":"user_not_found","request_id":"req-1"}`},
+		{"text/html, application/json;q=0.5", "text/html",
+			`<h1>404 Not Found</h1><p>No &lt;user&gt; 7</p><small>req-1</small>`},
+		{"image/png", "application/json",
+			`{"status":404,"message":"No <user> 7","code":"user_not_found","request_id":"req-1"}`},
+		{"application/json;q=0, */*", "text/html",
+			`<h1>404 Not Found</h1><p>No &lt;user&gt; 7</p><small>req-1</small>`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/users/7", nil)
+			r.Header.Set("Accept", tt.accept)
+			r = r.WithContext(ContextWithRequestID(r.Context(), "req-1"))
+			w := httptest.NewRecorder()
+			formatter.Format(w, r, err)
+
+			if w.Code != http.StatusNotFound {
+				t.Errorf("Expected status 404, got %d", w.Code)
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Expected Content-Type '%s', got '%s'", tt.contentType, got)
+			}
+			if w.Body.String() != tt.body {
+				t.Errorf("Expected body '%s', got '%s'", tt.body, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestTemplateFormatterSetRejectsUnescapedHTML(t *testing.T) {
+	SetLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	defer SetLogger(nil)
+
+	formatter := NewTemplateFormatterSet(map[string]Template{
+		"text/plain": template.Must(template.New("plain").Parse(`{{.Message}}`)),
+		"text/html":  template.Must(template.New("html").Parse(`<p>{{.Message}}</p>`)),
+	}, "text/plain")
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept", "text/html")
+	w := httptest.NewRecorder()
+	formatter.Format(w, r, NotFound("<script>alert(1)</script>"))
+
+	if ct := w.Header().Get("Content-Type"); ct != "text/plain" {
+		t.Errorf("Expected Content-Type 'text/plain', got '%s'", ct)
+	}
+	if strings.Contains(w.Body.String(), "<p>") {
+		t.Errorf("Expected text/template HTML page to be ignored, got '%s'", w.Body.String())
+	}
+}
+
+func TestHandlePreflight(t *testing.T) {
+	called := false
+	handler := NewHandler(HandlePreflight(
+		[]string{"https://app.example.com"},
+		[]string{"GET", "PUT"},
+		[]string{"Content-Type", "Authorization"},
+	)(func(w http.ResponseWriter, r *http.Request) error {
+		called = true
+		return NotFound("missing")
+	}))
+
+	t.Run("preflight", func(t *testing.T) {
+		called = false
+		r := httptest.NewRequest("OPTIONS", "/items/1", nil)
+		r.Header.Set("Origin", "https://app.example.com")
+		r.Header.Set("Access-Control-Request-Method", "PUT")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if called {
+			t.Error("Expected handler not to be called for a preflight")
+		}
+		if w.Code != http.StatusNoContent {
+			t.Errorf("Expected status 204, got %d", w.Code)
+		}
+		expected := map[string]string{
+			"Access-Control-Allow-Origin":  "https://app.example.com",
+			"Access-Control-Allow-Methods": "GET, PUT",
+			"Access-Control-Allow-Headers": "Content-Type, Authorization",
+			"Vary":                         "Origin",
+		}
+		for k, v := range expected {
+			if got := w.Header().Get(k); got != v {
+				t.Errorf("Expected %s '%s', got '%s'", k, v, got)
+			}
+		}
+	})
+
+	t.Run("disallowed origin", func(t *testing.T) {
+		r := httptest.NewRequest("OPTIONS", "/items/1", nil)
+		r.Header.Set("Origin", "https://evil.example.com")
+		r.Header.Set("Access-Control-Request-Method", "PUT")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected status 403, got %d", w.Code)
+		}
+	})
+
+	t.Run("normal request", func(t *testing.T) {
+		called = false
+		r := httptest.NewRequest("GET", "/items/1", nil)
+		r.Header.Set("Origin", "https://app.example.com")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if !called {
+			t.Error("Expected handler to be called")
+		}
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Expected status 404, got %d", w.Code)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://app.example.com" {
+			t.Errorf("Expected Access-Control-Allow-Origin on error response, got '%s'", got)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Methods"); got != "" {
+			t.Errorf("Expected no Access-Control-Allow-Methods, got '%s'", got)
+		}
+	})
+}
+
+func TestWithCategory(t *testing.T) {
+	err := WithCategory(Wrap(503, "Database unavailable", errors.New("dial tcp: refused")), "db")
+	err = WithCode(WithHeader(err, "Retry-After", "5"), "db_down")
+	if got := CategoryOf(err); got != "db" {
+		t.Errorf("Expected category 'db', got '%s'", got)
+	}
+	if got := CategoryOf(NotFound("")); got != "" {
+		t.Errorf("Expected no category, got '%s'", got)
+	}
+
+	var rec map[string]any
+	json.Unmarshal(LogJSON(nil, err), &rec)
+	if rec["category"] != "db" {
+		t.Errorf("Expected category in JSON log, got %v", rec["category"])
+	}
+	if line := Logfmt(nil, err); !strings.Contains(line, " category=db") {
+		t.Errorf("Expected category in logfmt line, got '%s'", line)
+	}
+
+	// The category is not part of the response body
+	w := httptest.NewRecorder()
+	NewJSONFormatter().Format(w, httptest.NewRequest("GET", "/", nil), err)
+	if strings.Contains(w.Body.String(), "category") {
+		t.Errorf("Expected no category in body, got %s", w.Body.String())
+	}
+
+	ResetStats()
+	defer ResetStats()
+	handler := NewHandler(func(w http.ResponseWriter, r *http.Request) error { return err })
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if stats := CategoryStats(); stats["db"] != 2 || len(stats) != 1 {
+		t.Errorf("Expected 2 db errors, got %v", stats)
+	}
+}
+
+func TestColorTextFormatter(t *testing.T) {
+	formatter := NewColorTextFormatter()
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Client", "cli")
+	w := httptest.NewRecorder()
+	formatter.Format(w, r, NotFound("No such \x1b[2Jbranch"))
+
+	expected := "\x1b[31m404\x1b[0m No such [2Jbranch\n"
+	if w.Body.String() != expected {
+		t.Errorf("Expected body %q, got %q", expected, w.Body.String())
+	}
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	formatter.Format(w, httptest.NewRequest("GET", "/", nil), NotFound("No such branch"))
+	if strings.Contains(w.Body.String(), "\x1b") {
+		t.Errorf("Expected no ANSI sequences without X-Client: cli, got %q", w.Body.String())
+	}
+	if w.Body.String() != "No such branch" {
+		t.Errorf("Expected plain text body, got %q", w.Body.String())
+	}
+}
+
+func TestFromResponse(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, _ := strconv.Atoi(r.URL.Query().Get("status"))
+		if status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable {
+			w.Header().Set("Retry-After", "30")
+		}
+		w.WriteHeader(status)
+		w.Write([]byte("internal upstream details"))
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		status     int
+		expected   int
+		retryAfter string
+	}{
+		{http.StatusTooManyRequests, http.StatusTooManyRequests, "30"},
+		{http.StatusServiceUnavailable, http.StatusServiceUnavailable, "30"},
+		{http.StatusNotFound, http.StatusNotFound, ""},
+		{http.StatusInternalServerError, http.StatusBadGateway, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.status), func(t *testing.T) {
+			resp, err := http.Get(upstream.URL + "?status=" + strconv.Itoa(tt.status))
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			defer resp.Body.Close()
+
+			httpErr := FromResponse(resp)
+			if httpErr == nil {
+				t.Fatal("Expected an error")
+			}
+			if httpErr.StatusCode() != tt.expected {
+				t.Errorf("Expected status %d, got %d", tt.expected, httpErr.StatusCode())
+			}
+			if got := httpErr.Headers()["Retry-After"]; got != tt.retryAfter {
+				t.Errorf("Expected Retry-After '%s', got '%s'", tt.retryAfter, got)
+			}
+			if strings.Contains(httpErr.Message(), "upstream details") {
+				t.Errorf("Expected upstream body not to be exposed, got '%s'", httpErr.Message())
+			}
+		})
+	}
+
+	if FromResponse(&http.Response{StatusCode: http.StatusOK}) != nil {
+		t.Error("Expected nil for a successful response")
+	}
+}
+
+func TestUse(t *testing.T) {
+	t.Cleanup(func() {
+		globalMiddlewareMu.Lock()
+		globalMiddleware = nil
+		globalMiddlewareMu.Unlock()
+	})
+
+	before := NewHandler(func(w http.ResponseWriter, r *http.Request) error {
+		return NotFound("missing")
+	})
+
+	var order []string
+	trace := func(name string) Middleware {
+		return func(next HandlerFunc) HandlerFunc {
+			return func(w http.ResponseWriter, r *http.Request) error {
+				order = append(order, name)
+				return next(w, r)
+			}
+		}
+	}
+	Use(trace("first"), trace("second"))
+	Use(trace("third"))
+
+	after := NewHandler(func(w http.ResponseWriter, r *http.Request) error {
+		order = append(order, "handler")
+		return NotFound("missing")
+	})
+	w := httptest.NewRecorder()
+	after.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if got := strings.Join(order, ","); got != "first,second,third,handler" {
+		t.Errorf("Expected 'first,second,third,handler', got '%s'", got)
+	}
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %d", w.Code)
+	}
+
+	order = nil
+	NewContextHandler(func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		order = append(order, "handler")
+		return nil
+	}).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if got := strings.Join(order, ","); got != "first,second,third,handler" {
+		t.Errorf("Expected context handler to run middleware, got '%s'", got)
+	}
+
+	order = nil
+	before.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if len(order) != 0 {
+		t.Errorf("Expected handler created before Use to be unaffected, got %v", order)
+	}
+}
+
+func TestPanicError(t *testing.T) {
+	type custom struct{ ID int }
+
+	var recovered HTTPError
+	handler := NewHandler(func(w http.ResponseWriter, r *http.Request) error {
+		panic(custom{ID: 7})
+	}, OnError(func(r *http.Request, err HTTPError) { recovered = err }))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	var panicErr *PanicError
+	if !errors.As(recovered, &panicErr) {
+		t.Fatalf("Expected a *PanicError cause, got %v", recovered)
+	}
+	if v, ok := panicErr.Value.(custom); !ok || v.ID != 7 {
+		t.Errorf("Expected panic value custom{7}, got %#v", panicErr.Value)
+	}
+	if !bytes.Contains(panicErr.Stack, []byte("TestPanicError")) {
+		t.Errorf("Expected stack to include the panicking function, got:\n%s", panicErr.Stack)
+	}
+	if bytes.Contains(panicErr.Stack, []byte("PanicToError")) {
+		t.Errorf("Expected recovery frames to be trimmed, got:\n%s", panicErr.Stack)
+	}
+
+	// Panics with an error value still match that error
+	sentinel := errors.New("sentinel")
+	if err := PanicToError(sentinel); !errors.Is(err, sentinel) {
+		t.Error("Expected errors.Is to find the panicked error")
+	}
+}
+
+func TestWithFormatterSelector(t *testing.T) {
+	handler := NewHandler(func(w http.ResponseWriter, r *http.Request) error {
+		return NotFound("missing")
+	}, WithFormatterSelector(func(r *http.Request) Formatter {
+		if r.Header.Get("X-Feature-New-Errors") == "on" {
+			return NewJSONFormatter()
+		}
+		return nil
+	}))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Feature-New-Errors", "on")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if got := w.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Expected JSON for flagged request, got '%s'", got)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if got := w.Header().Get("Content-Type"); got != "text/plain" {
+		t.Errorf("Expected plain text otherwise, got '%s'", got)
+	}
+	if w.Body.String() != "missing" {
+		t.Errorf("Expected body 'missing', got '%s'", w.Body.String())
+	}
+}
+
+func TestRoutePattern(t *testing.T) {
+	var route string
+	var logged map[string]any
+	mux := http.NewServeMux()
+	mux.Handle("GET /users/{id}", NewHandler(func(w http.ResponseWriter, r *http.Request) error {
+		return NotFound("User not found")
+	}, OnError(func(r *http.Request, err HTTPError) {
+		route = RoutePattern(r)
+		json.Unmarshal(LogJSON(r, err), &logged)
+	}), WithServerTiming("app")))
+
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/42", nil))
+	if route != "GET /users/{id}" {
+		t.Errorf("Expected route 'GET /users/{id}', got '%s'", route)
+	}
+	if logged["route"] != "GET /users/{id}" {
+		t.Errorf("Expected route in log record, got %v", logged["route"])
+	}
+
+	plain := httptest.NewRequest("GET", "/plain", nil)
+	if got := RoutePattern(plain); got != "/plain" {
+		t.Errorf("Expected fallback to the path, got '%s'", got)
+	}
+	json.Unmarshal(LogJSON(plain, NotFound("")), &logged)
+	if logged["route"] != "/plain" {
+		t.Errorf("Expected route fallback in log record, got %v", logged["route"])
+	}
+	if line := Logfmt(plain, NotFound("")); !strings.Contains(line, " route=/plain ") {
+		t.Errorf("Expected route fallback in logfmt line, got '%s'", line)
+	}
+}
+
+func TestAsHandler(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/v1/legacy", AsHandler(WithHeader(Gone("Use /v2 instead"), "Link", "</v2>; rel=successor-version"), NewJSONFormatter()))
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/v1/legacy", nil))
+
+	if w.Code != http.StatusGone {
+		t.Errorf("Expected status 410, got %d", w.Code)
+	}
+	if got := w.Header().Get("Link"); got != "</v2>; rel=successor-version" {
+		t.Errorf("Expected Link header, got '%s'", got)
+	}
+	var body map[string]any
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if body["error"] != "Use /v2 instead" {
+		t.Errorf("Expected error 'Use /v2 instead', got %v", body["error"])
+	}
+
+	w = httptest.NewRecorder()
+	AsHandler(Gone(""), nil).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusGone || w.Body.String() != "Gone" {
+		t.Errorf("Expected plain text 410 'Gone', got %d '%s'", w.Code, w.Body.String())
+	}
+}
+
+func TestDryRunWriter(t *testing.T) {
+	d := NewDryRunWriter()
+	d.Header().Set("X-Test", "1")
+	d.WriteHeader(http.StatusTeapot)
+	d.WriteHeader(http.StatusOK)
+	d.Write([]byte("short and stout"))
+
+	if d.Status != http.StatusTeapot {
+		t.Errorf("Expected status 418, got %d", d.Status)
+	}
+	if d.Header().Get("X-Test") != "1" || d.Body.String() != "short and stout" {
+		t.Errorf("Unexpected recording: %v '%s'", d.Header(), d.Body.String())
+	}
+
+	implicit := &DryRunWriter{}
+	implicit.Write([]byte("ok"))
+	if implicit.Status != http.StatusOK {
+		t.Errorf("Expected implicit status 200, got %d", implicit.Status)
+	}
+}
+
+func TestSimulateError(t *testing.T) {
+	status, headers, body := SimulateError(func(w http.ResponseWriter, r *http.Request) error {
+		return WithRetryAfter(ServiceUnavailable("Maintenance"), 2*time.Second)
+	}, httptest.NewRequest("GET", "/", nil))
+
+	if status != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503, got %d", status)
+	}
+	if headers.Get("Retry-After") != "2" || headers.Get("Content-Type") != "text/plain" {
+		t.Errorf("Unexpected headers: %v", headers)
+	}
+	if string(body) != "Maintenance" {
+		t.Errorf("Expected body 'Maintenance', got '%s'", body)
+	}
+
+	status, _, body = SimulateError(func(w http.ResponseWriter, r *http.Request) error {
+		return nil
+	}, httptest.NewRequest("GET", "/", nil))
+	if status != http.StatusOK || len(body) != 0 {
+		t.Errorf("Expected empty 200, got %d '%s'", status, body)
+	}
+}
+
+func TestAuthError(t *testing.T) {
+	tests := []struct {
+		name          string
+		authorization string
+		authenticated bool
+		status        int
+		code          string
+	}{
+		{"no credentials", "", false, http.StatusUnauthorized, "authentication_required"},
+		{"rejected credentials", "Bearer expired", false, http.StatusUnauthorized, "invalid_credentials"},
+		{"missing permission", "Bearer valid", true, http.StatusForbidden, "permission_denied"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("DELETE", "/repos/1", nil)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			err := AuthError(r, tt.authenticated, "repo:delete")
+			if err.StatusCode() != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, err.StatusCode())
+			}
+			if got := CodeOf(err); got != tt.code {
+				t.Errorf("Expected code '%s', got '%s'", tt.code, got)
+			}
+			if tt.status == http.StatusUnauthorized && !strings.HasPrefix(err.Headers()["WWW-Authenticate"], "Bearer") {
+				t.Errorf("Expected a Bearer challenge, got '%s'", err.Headers()["WWW-Authenticate"])
+			}
+		})
+	}
+
+	if got := FieldsOf(ForbiddenNoPermission("repo:delete"))["scope"]; got != "repo:delete" {
+		t.Errorf("Expected scope field 'repo:delete', got %v", got)
+	}
+}
+
+func TestWireRoundTrip(t *testing.T) {
+	original := WithCode(NotFound("Order not found"), "order_not_found")
+	original = WithHeaders(original, map[string]string{"Cache-Control": "no-store", "X-Shard": "eu-1"})
+	original = WithFields(original, map[string]any{"order_id": "A-17", "attempts": 3})
+	original = WithInternalFields(original, map[string]any{"query": "SELECT ..."})
+
+	decoded, err := UnmarshalWire(MarshalWire(original))
+	if err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+	if decoded.StatusCode() != 404 || decoded.Message() != "Order not found" || CodeOf(decoded) != "order_not_found" {
+		t.Errorf("Expected 404 'Order not found' order_not_found, got %d '%s' %s",
+			decoded.StatusCode(), decoded.Message(), CodeOf(decoded))
+	}
+	headers := decoded.Headers()
+	if headers["Cache-Control"] != "no-store" || headers["X-Shard"] != "eu-1" {
+		t.Errorf("Expected headers to round-trip, got %v", headers)
+	}
+	fields := FieldsOf(decoded)
+	if fields["order_id"] != "A-17" || fields["attempts"] != float64(3) {
+		t.Errorf("Expected fields to round-trip, got %v", fields)
+	}
+	if InternalFieldsOf(decoded) != nil {
+		t.Error("Expected internal fields not to be propagated")
+	}
+
+	if _, err := UnmarshalWire([]byte(`{"status":0,"message":"x"}`)); err == nil {
+		t.Error("Expected an error for an invalid status")
+	}
+	if _, err := UnmarshalWire([]byte(`not json`)); err == nil {
+		t.Error("Expected an error for invalid JSON")
+	}
+}
+
+func TestWireEncodedThroughGateway(t *testing.T) {
+	original := WithCode(WithField(Conflict("Seat taken"), "seat", "12C"), "seat_taken")
+	upstream := httptest.NewServer(NewHandlerWithFormatter(func(w http.ResponseWriter, r *http.Request) error {
+		return original
+	}, WireEncoded(NewJSONFormatter())))
+	defer upstream.Close()
+
+	resp, err := http.Get(upstream.URL)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if plain := FromResponse(resp); CodeOf(plain) != "" {
+		t.Errorf("Expected FromResponse to ignore %s, got code %s", EncodedErrorHeader, CodeOf(plain))
+	}
+	reconstructed := FromTrustedResponse(resp)
+	if reconstructed.StatusCode() != http.StatusConflict || reconstructed.Message() != "Seat taken" {
+		t.Errorf("Expected 409 'Seat taken', got %d '%s'", reconstructed.StatusCode(), reconstructed.Message())
+	}
+	if CodeOf(reconstructed) != "seat_taken" || FieldsOf(reconstructed)["seat"] != "12C" {
+		t.Errorf("Expected code and fields to be reconstructed, got %s %v", CodeOf(reconstructed), FieldsOf(reconstructed))
+	}
+}
+
+func TestRequireHeaders(t *testing.T) {
+	r := httptest.NewRequest("POST", "/payments", nil)
+	r.Header.Set("Content-Type", "application/json")
+
+	err := RequireHeaders(r, "content-type", "idempotency-key", "X-Tenant")
+	if err == nil {
+		t.Fatal("Expected an error for missing headers")
+	}
+	if err.StatusCode() != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", err.StatusCode())
+	}
+	if err.Message() != "Missing required headers: Idempotency-Key, X-Tenant" {
+		t.Errorf("Unexpected message '%s'", err.Message())
+	}
+	missing, _ := FieldsOf(err)["missing_headers"].([]string)
+	if strings.Join(missing, ",") != "Idempotency-Key,X-Tenant" {
+		t.Errorf("Expected missing_headers field, got %v", missing)
+	}
+
+	r.Header.Set("Idempotency-Key", "k-1")
+	r.Header.Set("X-Tenant", "acme")
+	if err := RequireHeaders(r, "Content-Type", "Idempotency-Key", "X-Tenant"); err != nil {
+		t.Errorf("Expected nil when all headers are present, got %v", err)
+	}
+}
+
+func TestWithErrorCodeHeader(t *testing.T) {
+	var err HTTPError
+	handler := NewHandler(func(w http.ResponseWriter, r *http.Request) error {
+		return err
+	}, WithErrorCodeHeader())
+
+	err = WithCode(NotFound("User not found"), "user_not_found")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if got := w.Header().Get("X-Error-Code"); got != "user_not_found" {
+		t.Errorf("Expected X-Error-Code 'user_not_found', got '%s'", got)
+	}
+
+	err = NotFound("User not found")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if _, ok := w.Header()["X-Error-Code"]; ok {
+		t.Errorf("Expected no X-Error-Code without a code, got '%s'", w.Header().Get("X-Error-Code"))
+	}
+}
+
+func TestRegisterRoutes(t *testing.T) {
+	ok := func(body string) HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) error {
+			w.Write([]byte(body))
+			return nil
+		}
+	}
+	mux := http.NewServeMux()
+	RegisterRoutes(mux, []Route{
+		{Pattern: "/users", Method: "GET", Handler: ok("list")},
+		{Pattern: "/users", Method: "post", Handler: func(w http.ResponseWriter, r *http.Request) error {
+			return BadRequest("Invalid user")
+		}, Formatter: NewJSONFormatter()},
+		{Pattern: "/users/{id}", Method: "GET", Handler: ok("user"), Formatter: NewJSONFormatter()},
+		{Pattern: "/health", Handler: ok("up")},
+	})
+
+	tests := []struct {
+		method, path string
+		status       int
+		body         string
+		allow        string
+		contentType  string
+	}{
+		{"GET", "/users", 200, "list", "", ""},
+		{"POST", "/users", 400, "", "", "application/json"},
+		{"DELETE", "/users", 405, "", "GET, HEAD, OPTIONS, POST", "text/plain"},
+		{"GET", "/users/7", 200, "user", "", ""},
+		{"PUT", "/users/7", 405, "", "GET, HEAD, OPTIONS", "application/json"},
+		{"DELETE", "/health", 200, "up", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+			if w.Code != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, w.Code)
+			}
+			if tt.body != "" && w.Body.String() != tt.body {
+				t.Errorf("Expected body '%s', got '%s'", tt.body, w.Body.String())
+			}
+			if got := w.Header().Get("Allow"); got != tt.allow {
+				t.Errorf("Expected Allow '%s', got '%s'", tt.allow, got)
+			}
+			if tt.contentType != "" && w.Header().Get("Content-Type") != tt.contentType {
+				t.Errorf("Expected Content-Type '%s', got '%s'", tt.contentType, w.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestWithTraceparent(t *testing.T) {
+	formatter := WithTraceparent(&PlainTextFormatter{})
+
+	incoming := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("traceparent", incoming)
+	w := httptest.NewRecorder()
+	formatter.Format(w, r, NotFound("missing"))
+	if got := w.Header().Get("traceparent"); got != incoming {
+		t.Errorf("Expected traceparent '%s' to be echoed, got '%s'", incoming, got)
+	}
+
+	for _, bad := range []string{"", "garbage", "00-00000000000000000000000000000000-00f067aa0ba902b7-01"} {
+		r := httptest.NewRequest("GET", "/", nil)
+		if bad != "" {
+			r.Header.Set("traceparent", bad)
+		}
+		w := httptest.NewRecorder()
+		formatter.Format(w, r, NotFound("missing"))
+		got := w.Header().Get("traceparent")
+		if got == bad || !validTraceparent(got) {
+			t.Errorf("Expected a generated well-formed traceparent for %q, got '%s'", bad, got)
+		}
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Expected status 404, got %d", w.Code)
+		}
+	}
+}
+
+func TestIdempotencyKeyRequired(t *testing.T) {
+	handler := NewHandlerWithFormatter(func(w http.ResponseWriter, r *http.Request) error {
+		if err := RequireIdempotencyKey(r); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusCreated)
+		return nil
+	}, NewJSONFormatter())
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/payments", nil))
+	if w.Code != http.StatusPreconditionRequired {
+		t.Errorf("Expected status 428, got %d", w.Code)
+	}
+	var body map[string]any
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if body["error_code"] != "idempotency_key_required" {
+		t.Errorf("Expected error_code 'idempotency_key_required', got %v", body["error_code"])
+	}
+
+	r := httptest.NewRequest("POST", "/payments", nil)
+	r.Header.Set("Idempotency-Key", "3f2a")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusCreated {
+		t.Errorf("Expected status 201 with a key, got %d", w.Code)
+	}
+}
+
+func TestFromTrustedResponseRejectsUnsafeEncodings(t *testing.T) {
+	encode := func(v string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(v))
+	}
+	resp := func(status int, encoded string) *http.Response {
+		return &http.Response{StatusCode: status, Header: http.Header{EncodedErrorHeader: {encoded}}}
+	}
+
+	// A successful status cannot be smuggled through the header
+	err := FromTrustedResponse(resp(500, encode(`{"status":200,"message":"all good"}`)))
+	if err.StatusCode() != http.StatusBadGateway || err.Message() == "all good" {
+		t.Errorf("Expected the encoded 200 to be rejected, got %d '%s'", err.StatusCode(), err.Message())
+	}
+
+	// Only allowlisted headers are propagated
+	err = FromTrustedResponse(resp(429, encode(
+		`{"status":429,"message":"slow down","headers":{"Retry-After":"7","Set-Cookie":"session=evil","Location":"https://evil.example.com"}}`)))
+	headers := err.Headers()
+	if headers["Retry-After"] != "7" {
+		t.Errorf("Expected Retry-After to be propagated, got %v", headers)
+	}
+	if _, ok := headers["Set-Cookie"]; ok {
+		t.Errorf("Expected Set-Cookie to be dropped, got %v", headers)
+	}
+	if _, ok := headers["Location"]; ok {
+		t.Errorf("Expected Location to be dropped, got %v", headers)
+	}
+}
+
+// detailedError is a custom HTTPError carrying details and a category
+type detailedError struct{}
+
+func (detailedError) Error() string              { return "quota exceeded" }
+func (detailedError) StatusCode() int            { return http.StatusTooManyRequests }
+func (detailedError) Message() string            { return "Quota exceeded" }
+func (detailedError) Headers() map[string]string { return nil }
+func (detailedError) Details() []any             { return []any{"quota:requests"} }
+func (detailedError) Category() string           { return "quota" }
+
+func TestWithHeaderKeepsCustomErrorDetails(t *testing.T) {
+	err := WithCode(WithHeader(detailedError{}, "Retry-After", "10"), "quota_exceeded")
+
+	if details := DetailsOf(err); len(details) != 1 || details[0] != "quota:requests" {
+		t.Errorf("Expected details to be kept, got %v", details)
+	}
+	var custom detailedError
+	if !errors.As(err, &custom) {
+		t.Error("Expected errors.As to reach the original custom error")
+	}
+	if !errors.Is(err, detailedError{}) {
+		t.Error("Expected errors.Is to match the original custom error")
+	}
+}
+
+func TestWithHeaderKeepsCustomErrorCategory(t *testing.T) {
+	err := WithHeader(detailedError{}, "Retry-After", "10")
+	if got := CategoryOf(err); got != "quota" {
+		t.Errorf("Expected category 'quota', got '%s'", got)
+	}
+
+	ResetStats()
+	defer ResetStats()
+	NewHandler(func(w http.ResponseWriter, r *http.Request) error {
+		return WithCode(err, "quota_exceeded")
+	}).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if stats := CategoryStats(); stats["quota"] != 1 {
+		t.Errorf("Expected 1 quota error, got %v", stats)
+	}
+}
+
+func TestContextHandlerNilAfterDeadline(t *testing.T) {
+	handler := NewContextHandler(func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		<-ctx.Done()
+		w.Write([]byte("partial result"))
+		return nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected the handler's own status 200, got %d", w.Code)
+	}
+	if w.Body.String() != "partial result" {
+		t.Errorf("Expected the handler's body only, got '%s'", w.Body.String())
+	}
+}
+
+func TestContextHandlerSilentNilAfterDeadline(t *testing.T) {
+	handler := NewContextHandler(func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		<-ctx.Done()
+		return nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("Expected status 504 when nothing was written, got %d", w.Code)
+	}
+}
+
+func TestRetryAfterValidation(t *testing.T) {
+	SetLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	defer SetLogger(nil)
+
+	tests := []struct {
+		value string
+		valid bool
+	}{
+		{"120", true},
+		{"Wed, 21 Oct 2015 07:28:00 GMT", true},
+		{"garbage", false},
+		{"-5", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		err := WithHeader(ServiceUnavailable("down"), "retry-after", tt.value)
+		_, ok := err.Headers()["retry-after"]
+		if ok != tt.valid {
+			t.Errorf("Expected Retry-After %q kept=%v, got %v", tt.value, tt.valid, ok)
+		}
+	}
+
+	// An invalid value does not replace a valid one
+	err := WithHeader(WithRetryAfter(ServiceUnavailable("down"), time.Minute), "Retry-After", "soon")
+	if got := err.Headers()["Retry-After"]; got != "60" {
+		t.Errorf("Expected Retry-After '60' to be kept, got '%s'", got)
+	}
+
+	templated := WithTemplatedHeader(ServiceUnavailable("down"), "Retry-After", "{{.Message}}")
+	if _, ok := templated.Headers()["Retry-After"]; ok {
+		t.Error("Expected an invalid templated Retry-After to be dropped")
+	}
+
+	upstream := FromResponse(&http.Response{StatusCode: 503, Header: http.Header{"Retry-After": {"whenever"}}})
+	if _, ok := upstream.Headers()["Retry-After"]; ok {
+		t.Error("Expected an invalid upstream Retry-After to be dropped")
+	}
+}
+
+func TestWithTraceparentNilBase(t *testing.T) {
+	w := httptest.NewRecorder()
+	WithTraceparent(nil).Format(w, httptest.NewRequest("GET", "/", nil), NotFound("missing"))
+	if w.Body.String() != "missing" || !validTraceparent(w.Header().Get("traceparent")) {
+		t.Errorf("Expected plain text with a traceparent, got '%s' %v", w.Body.String(), w.Header())
+	}
+}
+
+func TestWireEncodedNilBase(t *testing.T) {
+	w := httptest.NewRecorder()
+	WireEncoded(nil).Format(w, httptest.NewRequest("GET", "/", nil), NotFound("missing"))
+	if w.Body.String() != "missing" || w.Header().Get(EncodedErrorHeader) == "" {
+		t.Errorf("Expected plain text with %s, got '%s' %v", EncodedErrorHeader, w.Body.String(), w.Header())
+	}
+}
+
+func TestColorTextFormatterTruncates(t *testing.T) {
+	formatter := &ColorTextFormatter{MaxBodySize: 20}
+	err := BadRequest(strings.Repeat("x", 100))
+
+	cli := httptest.NewRequest("GET", "/", nil)
+	cli.Header.Set("X-Client", "cli")
+	w := httptest.NewRecorder()
+	formatter.Format(w, cli, err)
+	expected := "\x1b[31m400\x1b[0m " + strings.Repeat("x", 5) + truncatedNotice + "\n"
+	if w.Body.String() != expected {
+		t.Errorf("Expected body %q, got %q", expected, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	formatter.Format(w, httptest.NewRequest("GET", "/", nil), err)
+	if w.Body.Len() != 20 {
+		t.Errorf("Expected plain body capped at 20 bytes, got %d", w.Body.Len())
+	}
+}
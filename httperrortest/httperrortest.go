@@ -0,0 +1,41 @@
+// Package httperrortest provides helpers for testing handlers and formatters built with httperror.
+package httperrortest
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/perbu/httperror"
+)
+
+// ExpectFormatted renders err with the formatter and compares the status code, Content-Type
+// and body byte-for-byte with what was recorded in w. The expected output is rendered for
+// a GET / request, so formatters that depend on the request should be tested directly.
+func ExpectFormatted(t testing.TB, w *httptest.ResponseRecorder, f httperror.Formatter, err httperror.HTTPError) {
+	t.Helper()
+
+	expected := httptest.NewRecorder()
+	f.Format(expected, httptest.NewRequest("GET", "/", nil), err)
+
+	if w.Code != expected.Code {
+		t.Errorf("Expected status %d, got %d", expected.Code, w.Code)
+	}
+	if got, want := w.Header().Get("Content-Type"), expected.Header().Get("Content-Type"); got != want {
+		t.Errorf("Expected Content-Type '%s', got '%s'", want, got)
+	}
+	if !bytes.Equal(w.Body.Bytes(), expected.Body.Bytes()) {
+		t.Errorf("Expected body %q, got %q", expected.Body.String(), w.Body.String())
+	}
+}
+
+// EqualIgnoringHeaders reports whether a and b have the same status code, message and
+// machine code. Headers and wrapped causes are not compared. Two nil errors are equal.
+func EqualIgnoringHeaders(a, b httperror.HTTPError) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.StatusCode() == b.StatusCode() &&
+		a.Message() == b.Message() &&
+		httperror.CodeOf(a) == httperror.CodeOf(b)
+}
@@ -0,0 +1,81 @@
+package httperrortest
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/perbu/httperror"
+)
+
+// recordingTB captures failures instead of failing the test
+type recordingTB struct {
+	testing.TB
+	failures []string
+}
+
+func (r *recordingTB) Helper() {}
+
+func (r *recordingTB) Errorf(format string, args ...any) {
+	r.failures = append(r.failures, fmt.Sprintf(format, args...))
+}
+
+func TestExpectFormatted(t *testing.T) {
+	err := httperror.WithCode(httperror.NotFound("user not found"), "user_not_found")
+
+	for name, formatter := range map[string]httperror.Formatter{
+		"JSON":      httperror.NewJSONFormatter(),
+		"PlainText": &httperror.PlainTextFormatter{},
+	} {
+		t.Run(name, func(t *testing.T) {
+			handler := httperror.NewHandlerWithFormatter(func(w http.ResponseWriter, r *http.Request) error {
+				return err
+			}, formatter)
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", "/users/1", nil))
+
+			ExpectFormatted(t, w, formatter, err)
+		})
+	}
+}
+
+func TestExpectFormattedMismatch(t *testing.T) {
+	w := httptest.NewRecorder()
+	(&httperror.PlainTextFormatter{}).Format(w, httptest.NewRequest("GET", "/", nil), httperror.NotFound("other"))
+
+	tb := &recordingTB{}
+	ExpectFormatted(tb, w, httperror.NewJSONFormatter(), httperror.BadRequest("bad"))
+
+	if len(tb.failures) != 3 {
+		t.Errorf("Expected status, content type and body mismatches, got %v", tb.failures)
+	}
+}
+
+func TestEqualIgnoringHeaders(t *testing.T) {
+	base := httperror.WithCode(httperror.NotFound("user not found"), "user_not_found")
+
+	tests := []struct {
+		name     string
+		a, b     httperror.HTTPError
+		expected bool
+	}{
+		{"identical", base, base, true},
+		{"different headers", base, httperror.WithHeader(base, "X-Trace", "abc"), true},
+		{"different cause", httperror.Wrap(404, "gone", fmt.Errorf("a")), httperror.Wrap(404, "gone", fmt.Errorf("b")), true},
+		{"different status", httperror.NotFound("x"), httperror.BadRequest("x"), false},
+		{"different message", httperror.NotFound("x"), httperror.NotFound("y"), false},
+		{"different code", base, httperror.WithCode(base, "other"), false},
+		{"both nil", nil, nil, true},
+		{"one nil", base, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := EqualIgnoringHeaders(tt.a, tt.b); got != tt.expected {
+				t.Errorf("Expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package httperror
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// JSONFormatter writes errors as JSON objects of the form
+// {"error": message, "status": 404, "code": "Not Found"}.
+// A machine code is added as "error_code", field errors as "errors", details as "details",
+// and attached fields are added as top-level members, or under "extensions" when
+// NestExtensions is set.
+type JSONFormatter struct {
+	NestExtensions bool
+	// KeyedErrors serializes field errors as an object keyed by field name,
+	// {"errors": {"name": "required"}}, instead of an array. Messages for the
+	// same field are joined with "; ".
+	KeyedErrors bool
+	// MaxErrors caps the number of serialized field errors. When exceeded, "truncated"
+	// is set to true. Zero means DefaultMaxSerializedErrors, a negative value disables the cap.
+	MaxErrors int
+}
+
+// NewJSONFormatter creates a JSONFormatter with attached fields at the top level
+func NewJSONFormatter() *JSONFormatter {
+	return &JSONFormatter{}
+}
+
+// Format implements the Formatter interface
+func (f *JSONFormatter) Format(w http.ResponseWriter, r *http.Request, err HTTPError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(err.StatusCode())
+	f.writeBody(w, err)
+}
+
+func (f *JSONFormatter) writeBody(w io.Writer, err HTTPError) error {
+	body := map[string]any{}
+	fields := FieldsOf(err)
+	if f.NestExtensions {
+		if len(fields) > 0 {
+			body["extensions"] = fields
+		}
+	} else {
+		for k, v := range fields {
+			body[k] = v
+		}
+	}
+
+	// The core members always win over attached fields
+	body["error"] = err.Message()
+	body["status"] = err.StatusCode()
+	body["code"] = statusText(err.StatusCode())
+	if code := CodeOf(err); code != "" {
+		body["error_code"] = code
+	}
+	if fieldErrors := FieldErrorsOf(err); len(fieldErrors) > 0 {
+		capped, truncated := capFieldErrors(fieldErrors, f.MaxErrors)
+		if f.KeyedErrors {
+			body["errors"] = keyFieldErrors(capped)
+		} else {
+			body["errors"] = capped
+		}
+		if truncated {
+			body["truncated"] = true
+		}
+	}
+	if details := DetailsOf(err); details != nil {
+		body["details"] = details
+	}
+	return json.NewEncoder(w).Encode(body)
+}
+
+// keyFieldErrors maps field names to their messages
+func keyFieldErrors(fieldErrors []FieldError) map[string]string {
+	keyed := make(map[string]string, len(fieldErrors))
+	for _, fe := range fieldErrors {
+		if existing, ok := keyed[fe.Field]; ok {
+			keyed[fe.Field] = existing + "; " + fe.Message
+			continue
+		}
+		keyed[fe.Field] = fe.Message
+	}
+	return keyed
+}
+
+// CompactJSONFormatter writes the smallest useful JSON body, {"e":"message"},
+// for constrained clients. The status is only conveyed by the status line.
+type CompactJSONFormatter struct {
+	// Key is the single member name. Defaults to "e".
+	Key string
+}
+
+// NewCompactJSONFormatter creates a CompactJSONFormatter using the key "e"
+func NewCompactJSONFormatter() *CompactJSONFormatter {
+	return &CompactJSONFormatter{Key: "e"}
+}
+
+// Format implements the Formatter interface
+func (f *CompactJSONFormatter) Format(w http.ResponseWriter, r *http.Request, err HTTPError) {
+	key := f.Key
+	if key == "" {
+		key = "e"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(err.StatusCode())
+	b, _ := json.Marshal(map[string]string{key: err.Message()})
+	w.Write(b)
+}
+
+// GoogleJSONFormatter writes errors in the shape used by Google APIs,
+// {"error": {"code": 404, "message": "...", "status": "NOT_FOUND"}}, with the status
+// mapped to its canonical code name
+type GoogleJSONFormatter struct{}
+
+// NewGoogleJSONFormatter creates a GoogleJSONFormatter
+func NewGoogleJSONFormatter() *GoogleJSONFormatter {
+	return &GoogleJSONFormatter{}
+}
+
+// Format implements the Formatter interface
+func (f *GoogleJSONFormatter) Format(w http.ResponseWriter, r *http.Request, err HTTPError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(err.StatusCode())
+	json.NewEncoder(w).Encode(map[string]any{
+		"error": map[string]any{
+			"code":    err.StatusCode(),
+			"message": err.Message(),
+			"status":  canonicalStatus(err.StatusCode()),
+		},
+	})
+}
+
+// canonicalStatus maps an HTTP status to the closest canonical Google API code name
+func canonicalStatus(code int) string {
+	switch code {
+	case http.StatusBadRequest:
+		return "INVALID_ARGUMENT"
+	case http.StatusUnauthorized:
+		return "UNAUTHENTICATED"
+	case http.StatusForbidden:
+		return "PERMISSION_DENIED"
+	case http.StatusNotFound:
+		return "NOT_FOUND"
+	case http.StatusConflict:
+		return "ABORTED"
+	case http.StatusPreconditionFailed:
+		return "FAILED_PRECONDITION"
+	case http.StatusRequestedRangeNotSatisfiable:
+		return "OUT_OF_RANGE"
+	case http.StatusTooManyRequests:
+		return "RESOURCE_EXHAUSTED"
+	case 499:
+		return "CANCELLED"
+	case http.StatusInternalServerError:
+		return "INTERNAL"
+	case http.StatusNotImplemented:
+		return "UNIMPLEMENTED"
+	case http.StatusServiceUnavailable:
+		return "UNAVAILABLE"
+	case http.StatusGatewayTimeout:
+		return "DEADLINE_EXCEEDED"
+	}
+	return "UNKNOWN"
+}
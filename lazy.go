@@ -0,0 +1,42 @@
+package httperror
+
+import (
+	"sync"
+)
+
+// lazyError is an HTTPError whose message is computed on first use
+type lazyError struct {
+	code    int
+	once    sync.Once
+	fn      func() string
+	message string
+}
+
+// NewLazy creates an HTTPError whose message is computed by fn the first time it is needed.
+// fn is called at most once, so expensive messages cost nothing if the error is swallowed.
+func NewLazy(code int, fn func() string) HTTPError {
+	return &lazyError{
+		code: checkStatus(code),
+		fn:   fn,
+	}
+}
+
+func (e *lazyError) Error() string {
+	return e.Message()
+}
+
+func (e *lazyError) StatusCode() int {
+	return e.code
+}
+
+func (e *lazyError) Message() string {
+	e.once.Do(func() {
+		e.message = e.fn()
+		e.fn = nil
+	})
+	return e.message
+}
+
+func (e *lazyError) Headers() map[string]string {
+	return make(map[string]string)
+}
@@ -0,0 +1,205 @@
+package httperror
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// packageLogger holds the *slog.Logger set with SetLogger
+var packageLogger atomic.Pointer[slog.Logger]
+
+// SetLogger sets the logger used for the package's own warnings.
+// Passing nil restores the default, slog.Default().
+func SetLogger(l *slog.Logger) {
+	packageLogger.Store(l)
+}
+
+// logger returns the logger set with SetLogger or slog.Default()
+func logger() *slog.Logger {
+	if l := packageLogger.Load(); l != nil {
+		return l
+	}
+	return slog.Default()
+}
+
+// logRecord is the structure written by LogJSON
+type logRecord struct {
+	Time     string            `json:"time"`
+	Level    string            `json:"level"`
+	Status   int               `json:"status"`
+	Method   string            `json:"method,omitempty"`
+	Path     string            `json:"path,omitempty"`
+	Route    string            `json:"route,omitempty"`
+	Message  string            `json:"message"`
+	Code     string            `json:"code,omitempty"`
+	Category string            `json:"category,omitempty"`
+	Cause    string            `json:"cause,omitempty"`
+	Fields   map[string]any    `json:"fields,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+}
+
+// LogJSON returns a compact, single-line JSON log record for an error. The record includes
+// the unsanitized cause, the internal fields and the request headers, with sensitive headers
+// redacted (see SetSensitiveHeaders). It is meant for logs, never for response bodies.
+func LogJSON(r *http.Request, err error) []byte {
+	httpErr := FromError(err)
+	if httpErr == nil {
+		return nil
+	}
+
+	rec := logRecord{
+		Time:     nowFunc().UTC().Format(time.RFC3339Nano),
+		Level:    logLevel(httpErr.StatusCode()),
+		Status:   httpErr.StatusCode(),
+		Message:  httpErr.Message(),
+		Code:     CodeOf(httpErr),
+		Category: CategoryOf(httpErr),
+		Fields:   InternalFieldsOf(httpErr),
+	}
+	if r != nil {
+		rec.Method = r.Method
+		rec.Path = r.URL.Path
+		rec.Route = RoutePattern(r)
+		if len(r.Header) > 0 {
+			rec.Headers = RedactHeaders(r.Header)
+		}
+	}
+	if cause := errors.Unwrap(httpErr); cause != nil {
+		rec.Cause = cause.Error()
+	}
+
+	b, _ := json.Marshal(rec)
+	return b
+}
+
+// Logfmt returns a logfmt line for an error, e.g.
+//
+//	status=404 method=GET path=/x route=/x msg="User not found" code=user_not_found field.shard=db-7
+//
+// Like LogJSON it includes the unsanitized cause and the internal fields, sorted by key,
+// and is meant for logs only.
+func Logfmt(r *http.Request, err error) string {
+	httpErr := FromError(err)
+	if httpErr == nil {
+		return ""
+	}
+
+	var b strings.Builder
+	writeLogfmt(&b, "status", strconv.Itoa(httpErr.StatusCode()))
+	if r != nil {
+		writeLogfmt(&b, "method", r.Method)
+		writeLogfmt(&b, "path", r.URL.Path)
+		writeLogfmt(&b, "route", RoutePattern(r))
+	}
+	writeLogfmt(&b, "msg", httpErr.Message())
+	if code := CodeOf(httpErr); code != "" {
+		writeLogfmt(&b, "code", code)
+	}
+	if category := CategoryOf(httpErr); category != "" {
+		writeLogfmt(&b, "category", category)
+	}
+	if cause := errors.Unwrap(httpErr); cause != nil {
+		writeLogfmt(&b, "cause", cause.Error())
+	}
+	fields := InternalFieldsOf(httpErr)
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		writeLogfmt(&b, "field."+logfmtKey(k), fmt.Sprint(fields[k]))
+	}
+	return b.String()
+}
+
+// writeLogfmt appends a key=value pair, quoting the value when it is empty or contains
+// spaces, quotes, '=' or control characters
+func writeLogfmt(b *strings.Builder, key, value string) {
+	if b.Len() > 0 {
+		b.WriteByte(' ')
+	}
+	b.WriteString(key)
+	b.WriteByte('=')
+	if value == "" || strings.ContainsFunc(value, func(r rune) bool {
+		return r <= ' ' || r == '=' || r == '"' || r == 0x7f
+	}) {
+		value = strconv.Quote(value)
+	}
+	b.WriteString(value)
+}
+
+// logfmtKey replaces characters that are not allowed in an unquoted logfmt key with '_'
+func logfmtKey(key string) string {
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r == '=' || r == '"' || r == 0x7f {
+			return '_'
+		}
+		return r
+	}, key)
+}
+
+// LogfmtLogger returns an OnError callback writing a Logfmt line per error to w.
+// Writes are serialized, so w does not need to be safe for concurrent use.
+func LogfmtLogger(w io.Writer) func(r *http.Request, err HTTPError) {
+	var mu sync.Mutex
+	return func(r *http.Request, err HTTPError) {
+		line := Logfmt(r, err) + "\n"
+		mu.Lock()
+		defer mu.Unlock()
+		io.WriteString(w, line)
+	}
+}
+
+// logLevel returns the log level name for a status code
+func logLevel(status int) string {
+	if status >= 500 {
+		return "error"
+	}
+	return "warn"
+}
+
+// CommonLogFormat returns an NCSA Common Log Format line for a request, e.g.
+//
+//	127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326
+func CommonLogFormat(r *http.Request, status, bytes int) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if host == "" {
+		host = "-"
+	}
+
+	user := "-"
+	if r.URL.User != nil && r.URL.User.Username() != "" {
+		user = r.URL.User.Username()
+	} else if name, _, ok := r.BasicAuth(); ok && name != "" {
+		user = name
+	}
+
+	size := "-"
+	if bytes > 0 {
+		size = strconv.Itoa(bytes)
+	}
+
+	return fmt.Sprintf("%s - %s [%s] %s %d %s",
+		host,
+		user,
+		nowFunc().Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(r.Method+" "+r.URL.RequestURI()+" "+r.Proto),
+		status,
+		size,
+	)
+}
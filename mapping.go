@@ -0,0 +1,84 @@
+package httperror
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+)
+
+// errorMapping maps a sentinel error to a status code
+type errorMapping struct {
+	target error
+	code   int
+}
+
+var (
+	errorMappingsMu sync.RWMutex
+	errorMappings   []errorMapping
+)
+
+// RegisterError maps a sentinel error to an HTTP status code for use by FromError.
+// Errors are matched with errors.Is in registration order. Registering the same
+// sentinel again replaces its status code. It panics if target is nil or not comparable,
+// such as a struct error with a slice field, since it could never match with errors.Is.
+func RegisterError(target error, code int) {
+	if target == nil || !reflect.ValueOf(target).Comparable() {
+		panic(fmt.Sprintf("httperror: RegisterError target %T is not a comparable error", target))
+	}
+	errorMappingsMu.Lock()
+	defer errorMappingsMu.Unlock()
+	for i := range errorMappings {
+		if errorMappings[i].target == target {
+			errorMappings[i].code = code
+			return
+		}
+	}
+	errorMappings = append(errorMappings, errorMapping{target: target, code: code})
+}
+
+// ErrorMappings returns a copy of the sentinel to status code mappings registered with RegisterError
+func ErrorMappings() map[error]int {
+	errorMappingsMu.RLock()
+	defer errorMappingsMu.RUnlock()
+	mappings := make(map[error]int, len(errorMappings))
+	for _, m := range errorMappings {
+		mappings[m.target] = m.code
+	}
+	return mappings
+}
+
+// lookupErrorMapping returns the status code registered for the first sentinel in err's chain
+func lookupErrorMapping(err error) (int, bool) {
+	errorMappingsMu.RLock()
+	defer errorMappingsMu.RUnlock()
+	for _, m := range errorMappings {
+		if errors.Is(err, m.target) {
+			return m.code, true
+		}
+	}
+	return 0, false
+}
+
+// FromError converts any error to an HTTPError using the full mapping:
+// an HTTPError anywhere in the chain is returned as is, then sentinels registered
+// with RegisterError are consulted, and anything else becomes a 500.
+//
+// Unlike AsHTTPError, which only recognizes an HTTPError at the top of the chain and
+// replaces everything else with a sanitized 500, FromError keeps err as the cause so it
+// remains available through errors.Is and errors.As. Messages are still the generic
+// status text, so the cause is never sent to clients.
+func FromError(err error) HTTPError {
+	if err == nil {
+		return nil
+	}
+	var httpErr HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr
+	}
+	if code, ok := lookupErrorMapping(err); ok {
+		return Wrap(code, http.StatusText(code), err)
+	}
+	return Wrap(http.StatusInternalServerError, "Internal Server Error", err)
+}
@@ -0,0 +1,184 @@
+package httperror
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Middleware wraps a HandlerFunc with additional behavior
+type Middleware func(HandlerFunc) HandlerFunc
+
+// globalMiddleware holds the middleware registered with Use
+var (
+	globalMiddlewareMu sync.RWMutex
+	globalMiddleware   []Middleware
+)
+
+// Use registers middleware applied to every Handler and ContextHandler created afterwards,
+// including through the convenience functions. Middleware runs in registration order,
+// the first registered being the outermost. Handlers created earlier are not affected.
+func Use(mw ...Middleware) {
+	globalMiddlewareMu.Lock()
+	defer globalMiddlewareMu.Unlock()
+	globalMiddleware = append(globalMiddleware, mw...)
+}
+
+// applyGlobalMiddleware wraps h with the middleware registered with Use
+func applyGlobalMiddleware(h HandlerFunc) HandlerFunc {
+	globalMiddlewareMu.RLock()
+	defer globalMiddlewareMu.RUnlock()
+	for i := len(globalMiddleware) - 1; i >= 0; i-- {
+		h = globalMiddleware[i](h)
+	}
+	return h
+}
+
+// applyGlobalMiddlewareContext wraps a ContextHandlerFunc with the middleware registered with Use
+func applyGlobalMiddlewareContext(h ContextHandlerFunc) ContextHandlerFunc {
+	globalMiddlewareMu.RLock()
+	empty := len(globalMiddleware) == 0
+	globalMiddlewareMu.RUnlock()
+	if empty {
+		return h
+	}
+	wrapped := applyGlobalMiddleware(func(w http.ResponseWriter, r *http.Request) error {
+		return h(r.Context(), w, r)
+	})
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		return wrapped(w, r.WithContext(ctx))
+	}
+}
+
+// RequireAccept returns a middleware that responds with 406 Not Acceptable unless the
+// request's Accept header matches one of the given media types. Wildcards such as
+// */* and application/* are honored, a more specific range with q=0 excludes a type,
+// and a missing Accept header accepts anything.
+func RequireAccept(mediaTypes ...string) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) error {
+			accept := r.Header.Values("Accept")
+			if len(accept) == 0 {
+				return next(w, r)
+			}
+			for _, mediaType := range mediaTypes {
+				if accepts(accept, mediaType) {
+					return next(w, r)
+				}
+			}
+			return NotAcceptable("Acceptable media types: " + strings.Join(mediaTypes, ", "))
+		}
+	}
+}
+
+// accepts reports whether the Accept header values allow mediaType
+func accepts(accept []string, mediaType string) bool {
+	q, _ := quality(parseAccept(accept), mediaType)
+	return q > 0
+}
+
+// WithCleanup returns a HandlerFunc that runs cleanup after h, even if h panics.
+// A cleanup failure is logged; if h succeeded it becomes a 500, otherwise h's error wins.
+// A 500 can only reach the client if h has not written a response yet.
+func WithCleanup(h HandlerFunc, cleanup func() error) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) (err error) {
+		defer func() {
+			cleanupErr := cleanup()
+			if cleanupErr == nil {
+				return
+			}
+			logger().Error("httperror: cleanup failed", "method", r.Method, "path", r.URL.Path, "error", cleanupErr)
+			if err == nil {
+				err = Wrap(http.StatusInternalServerError, "Internal Server Error", cleanupErr)
+			}
+		}()
+		return h(w, r)
+	}
+}
+
+// Deprecated returns a middleware marking every response, including errors, as coming
+// from a deprecated endpoint with the Deprecation and Sunset (RFC 8594) headers
+func Deprecated(sunset time.Time) Middleware {
+	sunsetValue := sunset.UTC().Format(http.TimeFormat)
+	return func(next HandlerFunc) HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) error {
+			w.Header().Set("Deprecation", "true")
+			w.Header().Set("Sunset", sunsetValue)
+			return next(w, r)
+		}
+	}
+}
+
+// RequireHTTPS returns a middleware rejecting plaintext requests. A request is plaintext
+// unless it arrived over TLS or, with trustProxy set, carries X-Forwarded-Proto: https.
+// With redirect set, the client is redirected to the https URL on r.Host, with a 301 for
+// GET and HEAD and a 308 otherwise so the body is resent; without it the request fails
+// with 403 Forbidden. Only set trustProxy behind a proxy that overwrites X-Forwarded-Proto.
+func RequireHTTPS(redirect, trustProxy bool) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) error {
+			if ExternalURL(r, trustProxy).Scheme == "https" {
+				return next(w, r)
+			}
+			if !redirect {
+				return Forbidden("HTTPS required")
+			}
+			u := ExternalURL(r, false)
+			u.Scheme = "https"
+			if r.Method == http.MethodGet || r.Method == http.MethodHead {
+				return MovedPermanently(u.String())
+			}
+			return WithHeader(New(http.StatusPermanentRedirect, "Permanent Redirect"), "Location", u.String())
+		}
+	}
+}
+
+// HandlePreflight returns a middleware answering CORS preflight requests (OPTIONS with
+// Origin and Access-Control-Request-Method) with 204 No Content and the CORS headers,
+// without calling the handler. Preflights from origins not in allowedOrigins get a 403.
+// Other requests from allowed origins pass through with Access-Control-Allow-Origin set,
+// so browsers can read error responses too. An origin of "*" allows any origin.
+func HandlePreflight(allowedOrigins, methods, headers []string) Middleware {
+	allowMethods := strings.Join(methods, ", ")
+	allowHeaders := strings.Join(headers, ", ")
+	return func(next HandlerFunc) HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) error {
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				return next(w, r)
+			}
+			preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+			addVary(w.Header(), "Origin")
+			if !originAllowed(allowedOrigins, origin) {
+				if preflight {
+					return Forbidden("Origin not allowed")
+				}
+				return next(w, r)
+			}
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			if !preflight {
+				return next(w, r)
+			}
+
+			w.Header().Set("Access-Control-Allow-Methods", allowMethods)
+			if allowHeaders != "" {
+				w.Header().Set("Access-Control-Allow-Headers", allowHeaders)
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return nil
+		}
+	}
+}
+
+// originAllowed reports whether origin is in allowed, compared case-insensitively
+func originAllowed(allowed []string, origin string) bool {
+	for _, o := range allowed {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
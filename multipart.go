@@ -0,0 +1,37 @@
+package httperror
+
+import (
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+)
+
+// FromMultipartError converts an error from parsing a multipart form, e.g. from
+// r.ParseMultipartForm or r.FormFile, to an HTTPError. Bodies or parts exceeding the
+// configured limits become a 413 and malformed forms a 400. Anything else is handled by
+// FromError. The original error is kept as the cause.
+func FromMultipartError(err error) HTTPError {
+	if err == nil {
+		return nil
+	}
+
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		return Wrap(http.StatusRequestEntityTooLarge, "Request body too large", err)
+	case errors.Is(err, multipart.ErrMessageTooLarge):
+		return Wrap(http.StatusRequestEntityTooLarge, "Multipart form too large", err)
+	case errors.Is(err, http.ErrNotMultipart):
+		return Wrap(http.StatusBadRequest, "Request is not a multipart form", err)
+	case errors.Is(err, http.ErrMissingBoundary):
+		return Wrap(http.StatusBadRequest, "Multipart boundary missing from Content-Type", err)
+	case errors.Is(err, http.ErrMissingFile):
+		return Wrap(http.StatusBadRequest, "Missing file in multipart form", err)
+	case errors.Is(err, io.ErrUnexpectedEOF), strings.HasPrefix(err.Error(), "multipart: "):
+		// mime/multipart reports malformed input with plain "multipart: ..." errors
+		return Wrap(http.StatusBadRequest, "Malformed multipart form", err)
+	}
+	return FromError(err)
+}
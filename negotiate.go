@@ -0,0 +1,158 @@
+package httperror
+
+import (
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// NegotiatingFormatter picks a formatter based on the request's Accept header
+type NegotiatingFormatter struct {
+	formatters map[string]Formatter
+	order      []string
+	// Fallback is used when no registered type is acceptable. If nil, such requests
+	// get a 406 Not Acceptable listing the available types instead of the error.
+	Fallback Formatter
+}
+
+// NewNegotiatingFormatter creates a NegotiatingFormatter with the given fallback
+func NewNegotiatingFormatter(fallback Formatter) *NegotiatingFormatter {
+	return &NegotiatingFormatter{
+		formatters: make(map[string]Formatter),
+		Fallback:   fallback,
+	}
+}
+
+// Register adds a formatter for a media type such as "application/json". When the client
+// has no preference, types are tried in registration order.
+func (f *NegotiatingFormatter) Register(mediaType string, formatter Formatter) *NegotiatingFormatter {
+	mediaType = strings.ToLower(mediaType)
+	if _, exists := f.formatters[mediaType]; !exists {
+		f.order = append(f.order, mediaType)
+	}
+	f.formatters[mediaType] = formatter
+	return f
+}
+
+// Format implements the Formatter interface
+func (f *NegotiatingFormatter) Format(w http.ResponseWriter, r *http.Request, err HTTPError) {
+	addVary(w.Header(), "Accept")
+	if formatter := f.negotiate(r); formatter != nil {
+		formatter.Format(w, r, err)
+		return
+	}
+	if f.Fallback != nil {
+		f.Fallback.Format(w, r, err)
+		return
+	}
+
+	available := strings.Join(f.order, ", ")
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusNotAcceptable)
+	w.Write([]byte("Not Acceptable. Available types: " + available))
+}
+
+// negotiate returns the registered formatter best matching the Accept header, or nil
+func (f *NegotiatingFormatter) negotiate(r *http.Request) Formatter {
+	accept := r.Header.Values("Accept")
+	if len(accept) == 0 {
+		if len(f.order) == 0 {
+			return nil
+		}
+		return f.formatters[f.order[0]]
+	}
+	if mediaType, ok := bestMatch(parseAccept(accept), f.order); ok {
+		return f.formatters[mediaType]
+	}
+	return nil
+}
+
+// addVary adds names to the Vary header, skipping those already listed, so nested
+// negotiating formatters and middleware do not repeat them
+func addVary(h http.Header, names ...string) {
+	for _, name := range names {
+		present := false
+		for _, value := range h.Values("Vary") {
+			for _, existing := range strings.Split(value, ",") {
+				if strings.EqualFold(strings.TrimSpace(existing), name) {
+					present = true
+				}
+			}
+		}
+		if !present {
+			h.Add("Vary", name)
+		}
+	}
+}
+
+// mediaRange is a parsed element of an Accept header
+type mediaRange struct {
+	typ, subtype string
+	q            float64
+}
+
+// parseAccept parses Accept header values into media ranges ordered by preference.
+// Ranges with q=0 are kept, since they exclude types a less specific range would match.
+func parseAccept(values []string) []mediaRange {
+	var ranges []mediaRange
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err != nil {
+				continue
+			}
+			q := 1.0
+			if v, ok := params["q"]; ok {
+				if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+					q = max(parsed, 0)
+				}
+			}
+			typ, subtype, _ := strings.Cut(mediaType, "/")
+			ranges = append(ranges, mediaRange{typ: typ, subtype: subtype, q: q})
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].q > ranges[j].q
+	})
+	return ranges
+}
+
+// quality returns the quality ranges give mediaType, taken from the most specific matching
+// range, and that range's index. The quality is 0 when no range matches.
+func quality(ranges []mediaRange, mediaType string) (q float64, index int) {
+	typ, subtype, _ := strings.Cut(strings.ToLower(mediaType), "/")
+	specificity := -1
+	index = -1
+	for i, mr := range ranges {
+		var s int
+		switch {
+		case mr.typ == typ && mr.subtype == subtype:
+			s = 2
+		case mr.typ == typ && mr.subtype == "*":
+			s = 1
+		case mr.typ == "*" && mr.subtype == "*":
+			s = 0
+		default:
+			continue
+		}
+		if s > specificity {
+			specificity, q, index = s, mr.q, i
+		}
+	}
+	return q, index
+}
+
+// bestMatch returns the candidate with the highest quality above 0. Ties go to the type
+// whose range comes first in the header, then to the earlier candidate.
+func bestMatch(ranges []mediaRange, candidates []string) (string, bool) {
+	best, bestQ, bestIndex := "", 0.0, 0
+	for _, candidate := range candidates {
+		q, index := quality(ranges, candidate)
+		if q > bestQ || (q == bestQ && q > 0 && index < bestIndex) {
+			best, bestQ, bestIndex = candidate, q, index
+		}
+	}
+	return best, bestQ > 0
+}
@@ -0,0 +1,95 @@
+package httperror
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strings"
+)
+
+// PanicError is the cause of errors returned by PanicToError. It keeps the recovered
+// value and the stack so logging code can retrieve them with errors.As.
+type PanicError struct {
+	// Value is the value passed to panic
+	Value any
+	// Stack is the stack of the panicking goroutine, starting at the frame that panicked
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// Unwrap returns the recovered value if it is an error
+func (e *PanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
+
+// PanicToError converts a value returned by recover() into an HTTPError.
+// An HTTPError is returned unchanged; any other value becomes a 500 whose cause is a
+// *PanicError holding the value and stack. The client-facing message never contains
+// the panic value. A nil value returns nil.
+func PanicToError(recovered any) HTTPError {
+	switch v := recovered.(type) {
+	case nil:
+		return nil
+	case HTTPError:
+		return v
+	}
+	cause := &PanicError{Value: recovered, Stack: panicStack()}
+	return Wrap(http.StatusInternalServerError, "Internal Server Error", cause)
+}
+
+// recoverPanic converts a panic in a handler into an error response.
+// http.ErrAbortHandler is re-panicked so net/http can abort the response as intended.
+func recoverPanic(w http.ResponseWriter, r *http.Request, opts *options, handleError func(http.ResponseWriter, *http.Request, error)) {
+	recovered := recover()
+	if recovered == nil {
+		return
+	}
+	if recovered == http.ErrAbortHandler {
+		panic(recovered)
+	}
+	if opts.onPanic != nil {
+		opts.onPanic(r, recovered, panicStack())
+	}
+	handleError(w, r, PanicToError(recovered))
+}
+
+// panicStack returns the stack of the panicking goroutine, starting at the frame that
+// panicked. Leading frames from the runtime and this package's recovery code are trimmed.
+func panicStack() []byte {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(2, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+
+	var b bytes.Buffer
+	trimming := true
+	for {
+		frame, more := frames.Next()
+		if trimming && !isRecoveryFrame(frame.Function) {
+			trimming = false
+		}
+		if !trimming {
+			fmt.Fprintf(&b, "%s\n\t%s:%d\n", frame.Function, frame.File, frame.Line)
+		}
+		if !more {
+			break
+		}
+	}
+	return b.Bytes()
+}
+
+// isRecoveryFrame reports whether a function belongs to the runtime panic machinery
+// or to this package's recovery code
+func isRecoveryFrame(function string) bool {
+	return strings.HasPrefix(function, "runtime.") ||
+		strings.HasPrefix(function, packagePath+".recoverPanic") ||
+		strings.HasPrefix(function, packagePath+".PanicToError") ||
+		strings.HasPrefix(function, packagePath+".panicStack")
+}
+
+// packagePath is the import path of this package, used to recognize its stack frames
+const packagePath = "github.com/perbu/httperror"
@@ -0,0 +1,50 @@
+package httperror
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// RedactedValue replaces the value of sensitive headers in logged output
+const RedactedValue = "[REDACTED]"
+
+// DefaultSensitiveHeaders are the headers redacted until SetSensitiveHeaders is called
+var DefaultSensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key"}
+
+// sensitiveHeaders holds the canonical names of the headers to redact
+var sensitiveHeaders atomic.Pointer[map[string]bool]
+
+func init() {
+	SetSensitiveHeaders(DefaultSensitiveHeaders...)
+}
+
+// SetSensitiveHeaders replaces the set of headers whose values are redacted wherever the
+// package logs or echoes request headers, such as LogJSON and the DebugFormatter.
+// Names are case-insensitive.
+func SetSensitiveHeaders(names ...string) {
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		set[http.CanonicalHeaderKey(name)] = true
+	}
+	sensitiveHeaders.Store(&set)
+}
+
+// isSensitiveHeader reports whether the header's value must not be logged
+func isSensitiveHeader(name string) bool {
+	return (*sensitiveHeaders.Load())[http.CanonicalHeaderKey(name)]
+}
+
+// RedactHeaders returns the headers as a flat map suitable for logging, with multiple
+// values joined by ", " and sensitive values replaced by RedactedValue
+func RedactHeaders(h http.Header) map[string]string {
+	redacted := make(map[string]string, len(h))
+	for name, values := range h {
+		if isSensitiveHeader(name) {
+			redacted[name] = RedactedValue
+			continue
+		}
+		redacted[name] = strings.Join(values, ", ")
+	}
+	return redacted
+}
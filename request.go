@@ -0,0 +1,56 @@
+package httperror
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// PathInt reads the path value name, as matched by a ServeMux pattern like /users/{id},
+// and parses it as an integer. A missing or non-numeric value returns a 400 Bad Request.
+func PathInt(r *http.Request, name string) (int, HTTPError) {
+	value := r.PathValue(name)
+	if value == "" {
+		return 0, BadRequestf("Missing path parameter %q", name)
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, BadRequestf("Path parameter %q must be an integer", name)
+	}
+	return n, nil
+}
+
+// RoutePattern returns the ServeMux pattern that matched the request, such as
+// "GET /users/{id}", for grouping errors per route in hooks and metrics. Requests not
+// routed by a ServeMux fall back to the URL path.
+func RoutePattern(r *http.Request) string {
+	if r.Pattern != "" {
+		return r.Pattern
+	}
+	return r.URL.Path
+}
+
+// RequireHeaders returns a 400 Bad Request listing the named headers that are missing or
+// empty on the request, also attached as the "missing_headers" field. It returns nil when
+// all are present.
+func RequireHeaders(r *http.Request, names ...string) HTTPError {
+	var missing []string
+	for _, name := range names {
+		if r.Header.Get(name) == "" {
+			missing = append(missing, http.CanonicalHeaderKey(name))
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	return WithField(BadRequest("Missing required headers: "+strings.Join(missing, ", ")), "missing_headers", missing)
+}
+
+// RequireIdempotencyKey returns IdempotencyKeyRequired unless the request carries an
+// Idempotency-Key header. Use RequireHeaders for headers that warrant a 400 instead.
+func RequireIdempotencyKey(r *http.Request) HTTPError {
+	if r.Header.Get("Idempotency-Key") == "" {
+		return IdempotencyKeyRequired()
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package httperror
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// DefaultRequestIDHeader is the header used by RequestID when no header is configured
+const DefaultRequestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength bounds incoming request IDs that are propagated
+const maxRequestIDLength = 128
+
+// RequestIDOptions configures the RequestID middleware
+type RequestIDOptions struct {
+	// Header is the request and response header carrying the ID. Defaults to X-Request-Id.
+	Header string
+	// Generator creates new IDs. Defaults to 16 random bytes, hex encoded.
+	Generator func() string
+	// IgnoreIncoming always generates a new ID instead of propagating the client's
+	IgnoreIncoming bool
+}
+
+type requestIDKey struct{}
+
+// RequestID returns a middleware that assigns every request an ID, propagating a valid
+// incoming ID unless disabled. The ID is set as a response header on all responses,
+// successful or not, and stored in the request context for handlers and formatters.
+func RequestID(opts RequestIDOptions) Middleware {
+	header := opts.Header
+	if header == "" {
+		header = DefaultRequestIDHeader
+	}
+	generate := opts.Generator
+	if generate == nil {
+		generate = newRequestID
+	}
+
+	return func(next HandlerFunc) HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) error {
+			id := ""
+			if !opts.IgnoreIncoming {
+				id = r.Header.Get(header)
+			}
+			if !validRequestID(id) {
+				id = generate()
+			}
+			w.Header().Set(header, id)
+			if st := requestStateOf(r.Context()); st != nil {
+				st.requestID = id
+			}
+			return next(w, r.WithContext(ContextWithRequestID(r.Context(), id)))
+		}
+	}
+}
+
+// ContextWithRequestID returns a copy of ctx carrying the request ID
+func ContextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFromContext returns the request ID stored in ctx, or "" if none
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestIDOf returns the request ID for a response being formatted. Formatters receive
+// the request as seen by the Handler, before middleware added the ID to its context, so
+// the ID RequestID recorded in the Handler's request state is consulted, whatever header
+// it was configured with. The default response header covers RequestID middleware
+// running outside the Handler.
+func requestIDOf(w http.ResponseWriter, r *http.Request) string {
+	if id := RequestIDFromContext(r.Context()); id != "" {
+		return id
+	}
+	if st := requestStateOf(r.Context()); st != nil && st.requestID != "" {
+		return st.requestID
+	}
+	return w.Header().Get(DefaultRequestIDHeader)
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validRequestID reports whether an incoming ID is safe to propagate
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= 0x20 || id[i] >= 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// RequestIDPlainTextFormatter is a plain text formatter that appends the request ID,
+// e.g. "User not found (request id: abc123)", so users can quote it in support requests
+type RequestIDPlainTextFormatter struct {
+	// MaxBodySize caps the body size as in PlainTextFormatter
+	MaxBodySize int
+}
+
+// Format implements Formatter interface for plain text responses
+func (f *RequestIDPlainTextFormatter) Format(w http.ResponseWriter, r *http.Request, err HTTPError) {
+	message := err.Message()
+	if id := requestIDOf(w, r); id != "" {
+		message += " (request id: " + id + ")"
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(err.StatusCode())
+	w.Write([]byte(truncateBody(message, f.MaxBodySize)))
+}
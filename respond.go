@@ -0,0 +1,28 @@
+package httperror
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Respond writes result as JSON with a 200 status when err is nil, and otherwise writes
+// err through the formatter exactly like a Handler would. It is meant as the final call
+// of service-style handlers:
+//
+//	user, err := svc.GetUser(ctx, id)
+//	httperror.Respond(w, r, user, err, formatter)
+func Respond[T any](w http.ResponseWriter, r *http.Request, result T, err error, formatter Formatter) {
+	if err != nil {
+		writeError(w, r, err, formatter, &options{})
+		return
+	}
+
+	body, marshalErr := json.Marshal(result)
+	if marshalErr != nil {
+		writeError(w, r, marshalErr, formatter, &options{})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(append(body, '\n'))
+}
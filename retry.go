@@ -0,0 +1,69 @@
+package httperror
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"time"
+)
+
+// retryBackoff returns the delay before the given retry, starting at 1
+var retryBackoff = func(retry int) time.Duration {
+	return 50 * time.Millisecond << (retry - 1)
+}
+
+// MaxRetryBodySize is the largest request body RetryTransient buffers for replay.
+// Requests with a larger body, or a body of unknown length, are not retried.
+const MaxRetryBodySize = 1 << 20
+
+// RetryTransient returns a HandlerFunc that calls h up to attempts times while it returns
+// a retryable error (see IsRetryable), with exponential backoff between attempts. Only
+// idempotent methods (GET, HEAD, PUT, DELETE, OPTIONS) with a body of known length up to
+// MaxRetryBodySize are retried. Each attempt writes to a buffer and only the final
+// attempt's response is sent, so h may write freely. Because of that buffering the writer
+// passed to h does not implement http.Flusher; do not wrap handlers that stream.
+func RetryTransient(h HandlerFunc, attempts int) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if attempts <= 1 || !isIdempotent(r.Method) {
+			return h(w, r)
+		}
+
+		var body []byte
+		if r.Body != nil && r.Body != http.NoBody {
+			if r.ContentLength < 0 || r.ContentLength > MaxRetryBodySize {
+				return h(w, r)
+			}
+			var err error
+			if body, err = io.ReadAll(io.LimitReader(r.Body, MaxRetryBodySize)); err != nil {
+				return Wrap(http.StatusBadRequest, "Failed to read request body", err)
+			}
+		}
+
+		for attempt := 1; ; attempt++ {
+			if body != nil {
+				r.Body = io.NopCloser(bytes.NewReader(body))
+			}
+			buf := NewDryRunWriter()
+			err := h(buf, r)
+			if err == nil || attempt == attempts || !IsRetryable(err) {
+				buf.flush(w)
+				return err
+			}
+
+			select {
+			case <-time.After(retryBackoff(attempt)):
+			case <-r.Context().Done():
+				buf.flush(w)
+				return err
+			}
+		}
+	}
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return true
+	}
+	return false
+}
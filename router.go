@@ -0,0 +1,132 @@
+package httperror
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// MethodRouter dispatches requests for a single path to handlers by HTTP method.
+// Unregistered methods get a 405 with an Allow header computed from the registered
+// methods, HEAD is served by the GET handler, and OPTIONS is answered automatically.
+// Mount it with NewHandler(router.Serve).
+type MethodRouter struct {
+	handlers map[string]HandlerFunc
+}
+
+// NewMethodRouter creates an empty MethodRouter
+func NewMethodRouter() *MethodRouter {
+	return &MethodRouter{
+		handlers: make(map[string]HandlerFunc),
+	}
+}
+
+// Handle registers a handler for a method, replacing any existing one
+func (m *MethodRouter) Handle(method string, h HandlerFunc) *MethodRouter {
+	m.handlers[strings.ToUpper(method)] = h
+	return m
+}
+
+// Allow returns the methods served for the path, including HEAD when GET is
+// registered and OPTIONS, sorted alphabetically
+func (m *MethodRouter) Allow() []string {
+	set := map[string]bool{http.MethodOptions: true}
+	for method := range m.handlers {
+		set[method] = true
+	}
+	if set[http.MethodGet] {
+		set[http.MethodHead] = true
+	}
+	methods := make([]string, 0, len(set))
+	for method := range set {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+// Serve dispatches the request by method. It is a HandlerFunc, not an http.Handler;
+// use NewHandler(m.Serve) to mount the router on a ServeMux.
+func (m *MethodRouter) Serve(w http.ResponseWriter, r *http.Request) error {
+	if h, ok := m.handlers[r.Method]; ok {
+		return h(w, r)
+	}
+	if r.Method == http.MethodHead {
+		if h, ok := m.handlers[http.MethodGet]; ok {
+			return h(w, r)
+		}
+	}
+
+	allow := strings.Join(m.Allow(), ", ")
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Allow", allow)
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	return WithHeader(MethodNotAllowed(""), "Allow", allow)
+}
+
+// Route declares a handler for RegisterRoutes
+type Route struct {
+	// Pattern is a ServeMux pattern without a method, such as "/users/{id}"
+	Pattern string
+	// Method is the HTTP method served. Empty serves all methods.
+	Method string
+	// Handler handles the requests
+	Handler HandlerFunc
+	// Formatter formats the handler's errors. Nil means PlainTextFormatter.
+	Formatter Formatter
+}
+
+// RegisterRoutes registers routes on mux in bulk. Routes sharing a pattern are served by a
+// MethodRouter, so other methods get a 405 with an Allow header; the 405 is formatted with
+// the formatter of the first route for the pattern. A route without a Method must not
+// share its pattern with other routes. The options apply to every registered handler.
+func RegisterRoutes(mux *http.ServeMux, routes []Route, opts ...Option) {
+	type patternRoutes struct {
+		router     *MethodRouter
+		formatters map[string]Formatter
+		fallback   Formatter
+	}
+	byPattern := make(map[string]*patternRoutes)
+	var patterns []string
+
+	for _, route := range routes {
+		formatter := route.Formatter
+		if formatter == nil {
+			formatter = &PlainTextFormatter{}
+		}
+		if route.Method == "" {
+			mux.Handle(route.Pattern, NewHandlerWithFormatter(route.Handler, formatter, opts...))
+			continue
+		}
+
+		pr, ok := byPattern[route.Pattern]
+		if !ok {
+			pr = &patternRoutes{
+				router:     NewMethodRouter(),
+				formatters: make(map[string]Formatter),
+				fallback:   formatter,
+			}
+			byPattern[route.Pattern] = pr
+			patterns = append(patterns, route.Pattern)
+		}
+		method := strings.ToUpper(route.Method)
+		pr.router.Handle(method, route.Handler)
+		pr.formatters[method] = formatter
+	}
+
+	for _, pattern := range patterns {
+		pr := byPattern[pattern]
+		selector := WithFormatterSelector(func(r *http.Request) Formatter {
+			if f, ok := pr.formatters[r.Method]; ok {
+				return f
+			}
+			if r.Method == http.MethodHead {
+				return pr.formatters[http.MethodGet]
+			}
+			return nil
+		})
+		mux.Handle(pattern, NewHandlerWithFormatter(pr.router.Serve, pr.fallback, append(opts[:len(opts):len(opts)], selector)...))
+	}
+}
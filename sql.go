@@ -0,0 +1,46 @@
+package httperror
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+)
+
+// SQLStateError is implemented by database driver errors exposing a SQLSTATE code,
+// such as those of pgx and lib/pq
+type SQLStateError interface {
+	error
+	SQLState() string
+}
+
+// sqlStateStatus maps SQLSTATE codes to status codes and messages
+var sqlStateStatus = map[string]struct {
+	code    int
+	message string
+}{
+	"23505": {http.StatusConflict, "Resource already exists"},
+	"23503": {http.StatusConflict, "Resource is referenced by other resources"},
+	"23502": {http.StatusBadRequest, "Missing required value"},
+	"23514": {http.StatusBadRequest, "Value violates a constraint"},
+	"40001": {http.StatusConflict, "Concurrent update, please retry"},
+}
+
+// FromSQLError converts a database/sql error to an HTTPError. sql.ErrNoRows becomes a 404
+// and driver errors implementing SQLStateError are mapped by SQLSTATE code, e.g. a unique
+// violation (23505) becomes a 409. Anything else is handled by FromError. The original
+// error is kept as the cause.
+func FromSQLError(err error) HTTPError {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return Wrap(http.StatusNotFound, "Not Found", err)
+	}
+	var stateErr SQLStateError
+	if errors.As(err, &stateErr) {
+		if s, ok := sqlStateStatus[stateErr.SQLState()]; ok {
+			return Wrap(s.code, s.message, err)
+		}
+	}
+	return FromError(err)
+}
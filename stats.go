@@ -0,0 +1,61 @@
+package httperror
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// errorCounts counts the errors written by all handlers, indexed by status code
+var errorCounts [600]atomic.Int64
+
+// categoryCounts counts the errors written by all handlers by category
+var (
+	categoryCountsMu sync.Mutex
+	categoryCounts   = make(map[string]int64)
+)
+
+// Stats returns a snapshot of the number of errors written by handlers, keyed by status
+// code. Statuses that have not occurred are left out.
+func Stats() map[int]int64 {
+	stats := make(map[int]int64)
+	for code := range errorCounts {
+		if n := errorCounts[code].Load(); n > 0 {
+			stats[code] = n
+		}
+	}
+	return stats
+}
+
+// CategoryStats returns a snapshot of the number of errors written by handlers, keyed by
+// the category set with WithCategory. Errors without a category are left out.
+func CategoryStats() map[string]int64 {
+	categoryCountsMu.Lock()
+	defer categoryCountsMu.Unlock()
+	stats := make(map[string]int64, len(categoryCounts))
+	for category, n := range categoryCounts {
+		stats[category] = n
+	}
+	return stats
+}
+
+// ResetStats sets all error counts to zero
+func ResetStats() {
+	for code := range errorCounts {
+		errorCounts[code].Store(0)
+	}
+	categoryCountsMu.Lock()
+	clear(categoryCounts)
+	categoryCountsMu.Unlock()
+}
+
+// countError records an error written by a handler
+func countError(err HTTPError) {
+	if code := err.StatusCode(); validStatus(code) {
+		errorCounts[code].Add(1)
+	}
+	if category := CategoryOf(err); category != "" {
+		categoryCountsMu.Lock()
+		categoryCounts[category]++
+		categoryCountsMu.Unlock()
+	}
+}
@@ -0,0 +1,61 @@
+package httperror
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// statusTexts holds the status text for every valid status code. It is replaced
+// as a whole by SetStatusText so formatters can read it without locking.
+var statusTexts atomic.Pointer[[600]string]
+
+func init() {
+	var texts [600]string
+	for code := range texts {
+		texts[code] = http.StatusText(code)
+	}
+	statusTexts.Store(&texts)
+}
+
+// SetStatusText overrides the status text formatters use for a code, e.g. "Whoops" for 500.
+// An empty text restores http.StatusText. Codes outside 100-599 are ignored.
+func SetStatusText(code int, text string) {
+	if code < 100 || code >= len(statusTexts.Load()) {
+		return
+	}
+	if text == "" {
+		text = http.StatusText(code)
+	}
+	for {
+		current := statusTexts.Load()
+		texts := *current
+		texts[code] = text
+		if statusTexts.CompareAndSwap(current, &texts) {
+			return
+		}
+	}
+}
+
+// statusText returns the status text used by formatters
+func statusText(code int) string {
+	texts := statusTexts.Load()
+	if code >= 0 && code < len(texts) {
+		return texts[code]
+	}
+	return http.StatusText(code)
+}
+
+// validStatus reports whether code is a legal HTTP status code
+func validStatus(code int) bool {
+	return code >= 100 && code <= 599
+}
+
+// checkStatus returns code if it is legal, and otherwise logs it and returns 500
+// so that a bad code never reaches WriteHeader, which panics on some of them
+func checkStatus(code int) int {
+	if validStatus(code) {
+		return code
+	}
+	logger().Error("httperror: invalid status code, using 500", "status", code)
+	return http.StatusInternalServerError
+}
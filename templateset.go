@@ -0,0 +1,104 @@
+package httperror
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Template is implemented by both *text/template.Template and *html/template.Template
+type Template interface {
+	Execute(w io.Writer, data any) error
+}
+
+// TemplateData is the data model passed to the templates of a TemplateFormatterSet
+type TemplateData struct {
+	Status     int
+	StatusText string
+	Message    string
+	Code       string
+	Fields     map[string]any
+	RequestID  string
+}
+
+// TemplateFormatterSet renders errors from one template per content type, all fed the
+// same TemplateData, and picks the template from the request's Accept header.
+// HTML types must use html/template so messages echoing user input are escaped.
+type TemplateFormatterSet struct {
+	templates   map[string]Template
+	order       []string
+	defaultType string
+}
+
+// NewTemplateFormatterSet creates a formatter rendering the template registered for the
+// best matching content type, e.g. "application/json" or "text/html". Requests without
+// an acceptable type get the template for defaultType, which must be in templates.
+// Templates for text/html or application/xhtml+xml that are not html/template
+// templates are ignored and logged.
+func NewTemplateFormatterSet(templates map[string]Template, defaultType string) *TemplateFormatterSet {
+	f := &TemplateFormatterSet{
+		templates:   make(map[string]Template, len(templates)),
+		defaultType: strings.ToLower(defaultType),
+	}
+	for contentType, tmpl := range templates {
+		contentType = strings.ToLower(contentType)
+		if _, ok := tmpl.(*htmltemplate.Template); isHTMLType(contentType) && !ok {
+			logger().Warn("httperror: ignoring unescaped template for HTML content type", "content_type", contentType)
+			continue
+		}
+		f.templates[contentType] = tmpl
+		if contentType != f.defaultType {
+			f.order = append(f.order, contentType)
+		}
+	}
+	// Wildcards match the default type first, then the others in a stable order
+	sort.Strings(f.order)
+	if _, ok := f.templates[f.defaultType]; ok {
+		f.order = append([]string{f.defaultType}, f.order...)
+	}
+	return f
+}
+
+// Format implements the Formatter interface. If the template is missing or fails to
+// execute, the message is written as plain text instead.
+func (f *TemplateFormatterSet) Format(w http.ResponseWriter, r *http.Request, err HTTPError) {
+	contentType := f.negotiate(r)
+	data := TemplateData{
+		Status:     err.StatusCode(),
+		StatusText: statusText(err.StatusCode()),
+		Message:    err.Message(),
+		Code:       CodeOf(err),
+		Fields:     FieldsOf(err),
+		RequestID:  requestIDOf(w, r),
+	}
+
+	var buf bytes.Buffer
+	tmpl := f.templates[contentType]
+	if tmpl == nil || tmpl.Execute(&buf, data) != nil {
+		buf.Reset()
+		buf.WriteString(err.Message())
+		contentType = "text/plain"
+	}
+
+	addVary(w.Header(), "Accept")
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(err.StatusCode())
+	w.Write(buf.Bytes())
+}
+
+// negotiate returns the registered content type best matching the Accept header,
+// or the default type
+func (f *TemplateFormatterSet) negotiate(r *http.Request) string {
+	if contentType, ok := bestMatch(parseAccept(r.Header.Values("Accept")), f.order); ok {
+		return contentType
+	}
+	return f.defaultType
+}
+
+// isHTMLType reports whether a content type is rendered as HTML by browsers
+func isHTMLType(contentType string) bool {
+	return contentType == "text/html" || contentType == "application/xhtml+xml"
+}
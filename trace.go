@@ -0,0 +1,55 @@
+package httperror
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// WithTraceparent decorates a formatter so error responses carry a W3C Trace Context
+// traceparent header. A well-formed incoming traceparent is echoed; otherwise a new one
+// with random trace and parent IDs is generated. A nil base means PlainTextFormatter.
+func WithTraceparent(base Formatter) Formatter {
+	if base == nil {
+		base = &PlainTextFormatter{}
+	}
+	return FormatterFunc(func(w http.ResponseWriter, r *http.Request, err HTTPError) {
+		traceparent := r.Header.Get("traceparent")
+		if !validTraceparent(traceparent) {
+			traceparent = newTraceparent()
+		}
+		w.Header().Set("traceparent", traceparent)
+		base.Format(w, r, err)
+	})
+}
+
+// validTraceparent reports whether s is a well-formed version 00 traceparent,
+// "00-{32 hex trace ID}-{16 hex parent ID}-{2 hex flags}", with non-zero IDs
+func validTraceparent(s string) bool {
+	parts := strings.Split(s, "-")
+	if len(parts) != 4 || parts[0] != "00" {
+		return false
+	}
+	for i, n := range []int{2, 32, 16, 2} {
+		if len(parts[i]) != n || !isLowerHex(parts[i]) {
+			return false
+		}
+	}
+	return strings.Trim(parts[1], "0") != "" && strings.Trim(parts[2], "0") != ""
+}
+
+func isLowerHex(s string) bool {
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func newTraceparent() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return "00-" + hex.EncodeToString(b[:16]) + "-" + hex.EncodeToString(b[16:]) + "-00"
+}
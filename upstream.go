@@ -0,0 +1,47 @@
+package httperror
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// FromResponse converts an upstream response, e.g. in a gateway, to an HTTPError to return
+// to the client. Responses below 400 return nil. Client errors keep their status, as do 503
+// and 504; other server errors become 502 Bad Gateway. The message is the status text, so
+// the upstream body is never exposed, and an upstream Retry-After is propagated.
+// An EncodedErrorHeader is ignored; see FromTrustedResponse. The response body is not read
+// or closed.
+func FromResponse(resp *http.Response) HTTPError {
+	if resp == nil || resp.StatusCode < 400 {
+		return nil
+	}
+
+	code := resp.StatusCode
+	switch {
+	case !validStatus(code):
+		code = http.StatusBadGateway
+	case code >= 500 && code != http.StatusServiceUnavailable && code != http.StatusGatewayTimeout:
+		code = http.StatusBadGateway
+	}
+
+	cause := fmt.Errorf("upstream responded with status %d", resp.StatusCode)
+	err := Wrap(code, statusText(code), cause)
+	if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "" {
+		err = WithHeader(err, "Retry-After", sanitizeHeaderValue(retryAfter))
+	}
+	return err
+}
+
+// FromTrustedResponse is like FromResponse, but reconstructs the original error from an
+// EncodedErrorHeader (see WireEncoded) when present. The encoded status must be 400-599 and
+// only headers that are safe to propagate, such as Retry-After and WWW-Authenticate, are
+// kept. Only use it for upstreams you control, since they choose the message sent to the client.
+func FromTrustedResponse(resp *http.Response) HTTPError {
+	if resp == nil || resp.StatusCode < 400 {
+		return nil
+	}
+	if err, ok := fromEncodedHeader(resp); ok {
+		return err
+	}
+	return FromResponse(resp)
+}
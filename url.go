@@ -0,0 +1,42 @@
+package httperror
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ExternalURL returns the absolute URL of the request as seen by the client. When
+// trustProxy is set, the scheme and host are taken from X-Forwarded-Proto and
+// X-Forwarded-Host; otherwise, or when those are missing, the TLS state and r.Host are used.
+// Only enable trustProxy behind a proxy that overwrites these headers.
+func ExternalURL(r *http.Request, trustProxy bool) *url.URL {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	host := r.Host
+
+	if trustProxy {
+		if proto := strings.ToLower(firstHeaderValue(r, "X-Forwarded-Proto")); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+		if fwdHost := firstHeaderValue(r, "X-Forwarded-Host"); fwdHost != "" {
+			host = fwdHost
+		}
+	}
+
+	return &url.URL{
+		Scheme:   scheme,
+		Host:     host,
+		Path:     r.URL.Path,
+		RawPath:  r.URL.RawPath,
+		RawQuery: r.URL.RawQuery,
+	}
+}
+
+// firstHeaderValue returns the first element of a possibly comma-separated header
+func firstHeaderValue(r *http.Request, name string) string {
+	value, _, _ := strings.Cut(r.Header.Get(name), ",")
+	return strings.TrimSpace(value)
+}
@@ -0,0 +1,86 @@
+package httperror
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// DefaultMaxSerializedErrors is the number of field errors serialized by formatters
+// when no explicit cap is configured
+const DefaultMaxSerializedErrors = 100
+
+// FieldError describes a problem with a single input field
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError creates a 400 Bad Request error listing the invalid fields
+func ValidationError(message string, fieldErrors ...FieldError) HTTPError {
+	if message == "" {
+		message = "Validation failed"
+	}
+	return WithFieldErrors(New(http.StatusBadRequest, message), fieldErrors...)
+}
+
+// ConflictFields creates a 409 Conflict error listing the fields that conflicted, e.g. in
+// an upsert or merge. The fields are serialized like validation field errors.
+func ConflictFields(fields ...FieldError) HTTPError {
+	return WithFieldErrors(New(http.StatusConflict, "Conflicting fields"), fields...)
+}
+
+// WithFieldErrors attaches field errors to an error, appending to any already attached.
+// A nil error is returned as nil.
+func WithFieldErrors(err HTTPError, fieldErrors ...FieldError) HTTPError {
+	if err == nil {
+		return nil
+	}
+	c := toBasic(err)
+	c.fieldErrors = append(c.fieldErrors, fieldErrors...)
+	return c
+}
+
+// FieldErrorsOf returns the field errors attached to an error, or nil if none
+func FieldErrorsOf(err error) []FieldError {
+	var fe interface{ FieldErrors() []FieldError }
+	if !errors.As(err, &fe) {
+		return nil
+	}
+	return append([]FieldError(nil), fe.FieldErrors()...)
+}
+
+// capFieldErrors limits fieldErrors to max entries, reporting whether any were dropped.
+// Zero means DefaultMaxSerializedErrors, a negative value disables the cap.
+func capFieldErrors(fieldErrors []FieldError, max int) ([]FieldError, bool) {
+	if max == 0 {
+		max = DefaultMaxSerializedErrors
+	}
+	if max < 0 || len(fieldErrors) <= max {
+		return fieldErrors, false
+	}
+	return fieldErrors[:max], true
+}
+
+// ProblemFieldError is an entry of the RFC 9457 "errors" extension member,
+// locating the invalid field with a JSON Pointer
+type ProblemFieldError struct {
+	Detail  string `json:"detail"`
+	Pointer string `json:"pointer"`
+}
+
+// ProblemErrors converts field errors to the RFC 9457 "errors" extension array,
+// e.g. FieldError{"name", "required"} becomes {"detail": "required", "pointer": "/name"}
+func ProblemErrors(fieldErrors ...FieldError) []ProblemFieldError {
+	out := make([]ProblemFieldError, 0, len(fieldErrors))
+	for _, fe := range fieldErrors {
+		out = append(out, ProblemFieldError{
+			Detail:  fe.Message,
+			Pointer: "/" + jsonPointerEscaper.Replace(fe.Field),
+		})
+	}
+	return out
+}
+
+// jsonPointerEscaper escapes a reference token as defined by RFC 6901
+var jsonPointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
@@ -0,0 +1,129 @@
+package httperror
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// EncodedErrorHeader carries the wire encoding of an error, base64url-encoded, so an
+// intermediary can reconstruct the original error with FromTrustedResponse
+const EncodedErrorHeader = "X-Error-Encoded"
+
+// wireError is the JSON wire format of an error
+type wireError struct {
+	Status  int               `json:"status"`
+	Message string            `json:"message"`
+	Code    string            `json:"code,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Fields  map[string]any    `json:"fields,omitempty"`
+}
+
+// MarshalWire encodes the status, message, machine code, headers and fields of an error as
+// JSON for propagation between services. Internal fields and the cause are not included.
+// A nil error returns nil.
+func MarshalWire(err HTTPError) []byte {
+	if err == nil {
+		return nil
+	}
+	headers := HeadersOf(err)
+	if len(headers) == 0 {
+		headers = nil
+	}
+	b, _ := json.Marshal(wireError{
+		Status:  err.StatusCode(),
+		Message: err.Message(),
+		Code:    CodeOf(err),
+		Headers: headers,
+		Fields:  FieldsOf(err),
+	})
+	return b
+}
+
+// UnmarshalWire decodes an error encoded with MarshalWire. Fields decode as JSON values,
+// so numbers become float64. Statuses outside 400-599 are rejected.
+func UnmarshalWire(data []byte) (HTTPError, error) {
+	w, err := decodeWire(data)
+	if err != nil {
+		return nil, err
+	}
+	return w.toError(w.Headers), nil
+}
+
+// decodeWire parses and validates the wire format
+func decodeWire(data []byte) (wireError, error) {
+	var w wireError
+	if err := json.Unmarshal(data, &w); err != nil {
+		return w, fmt.Errorf("httperror: decoding wire error: %w", err)
+	}
+	if w.Status < 400 || !validStatus(w.Status) {
+		return w, fmt.Errorf("httperror: invalid status %d in wire error", w.Status)
+	}
+	return w, nil
+}
+
+// toError builds the HTTPError described by w with the given headers
+func (w wireError) toError(headers map[string]string) HTTPError {
+	err := New(w.Status, w.Message)
+	if len(headers) > 0 {
+		err = WithHeaders(err, headers)
+	}
+	if w.Code != "" {
+		err = WithCode(err, w.Code)
+	}
+	if len(w.Fields) > 0 {
+		err = WithFields(err, w.Fields)
+	}
+	return err
+}
+
+// WireEncoded decorates a formatter so error responses carry the EncodedErrorHeader,
+// letting gateways that use FromTrustedResponse propagate the original error.
+// Only use it between trusted services. A nil base means PlainTextFormatter.
+func WireEncoded(base Formatter) Formatter {
+	if base == nil {
+		base = &PlainTextFormatter{}
+	}
+	return FormatterFunc(func(w http.ResponseWriter, r *http.Request, err HTTPError) {
+		w.Header().Set(EncodedErrorHeader, base64.RawURLEncoding.EncodeToString(MarshalWire(err)))
+		base.Format(w, r, err)
+	})
+}
+
+// propagatedWireHeaders are the headers FromTrustedResponse takes over from an encoded
+// error. Others, such as Set-Cookie or Location, are dropped.
+var propagatedWireHeaders = map[string]bool{
+	"Allow":            true,
+	"Cache-Control":    true,
+	"Content-Language": true,
+	"Deprecation":      true,
+	"Link":             true,
+	"Retry-After":      true,
+	"Sunset":           true,
+	"Www-Authenticate": true,
+}
+
+// fromEncodedHeader reconstructs the error carried in a response's EncodedErrorHeader,
+// keeping only the headers in propagatedWireHeaders
+func fromEncodedHeader(resp *http.Response) (HTTPError, bool) {
+	value := resp.Header.Get(EncodedErrorHeader)
+	if value == "" {
+		return nil, false
+	}
+	data, decodeErr := base64.RawURLEncoding.DecodeString(value)
+	if decodeErr != nil {
+		return nil, false
+	}
+	w, decodeErr := decodeWire(data)
+	if decodeErr != nil {
+		return nil, false
+	}
+	headers := make(map[string]string)
+	for k, v := range w.Headers {
+		if propagatedWireHeaders[http.CanonicalHeaderKey(k)] {
+			headers[k] = sanitizeHeaderValue(v)
+		}
+	}
+	return w.toError(headers), true
+}